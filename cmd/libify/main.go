@@ -0,0 +1,317 @@
+// Command libify converts a Go command line app to a library.
+//
+// Usage:
+//
+//	libify <command> [flags] <path>...
+//
+// Commands:
+//
+//	run      convert the commands at <path>... (and the packages they import) in place
+//	analyze  report constructs that can't be converted, without making any changes
+//	diff     convert a copy of the module and print a diff of the changes
+//	verify   convert a copy of the module, then vet it (and test it if -tests is set)
+//
+// Each <path> is a package path (e.g. github.com/foo/bar/cmd/baz) or a relative dir (e.g.
+// ./cmd/baz). Several commands can be converted together: the packages they share are converted
+// once. If -root and -dir are omitted they are found from the nearest go.mod.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dave/libify"
+	"github.com/dave/libify/libgo"
+	"github.com/pkg/errors"
+)
+
+const usage = `Usage: libify <command> [flags] <path>...
+
+Commands:
+  run      convert the commands at <path>... (and the packages they import) in place
+  analyze  report constructs that can't be converted, without making any changes
+  diff     convert a copy of the module and print a diff of the changes
+  verify   convert a copy of the module, then vet it (and test it if -tests is set)
+
+Run "libify <command> -h" for the flags of a command.
+`
+
+var commands = map[string]func(ctx context.Context, options libify.Options) error{
+	"run":     run,
+	"analyze": analyze,
+	"diff":    diff,
+	"verify":  verify,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "libify: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	options, closer, err := parseOptions(os.Args[1], os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "libify: %v\n", err)
+		os.Exit(2)
+	}
+	err = command(context.Background(), options)
+	closer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "libify %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// parseOptions parses the flags and path argument of a command. The returned func closes any files
+// opened for the options.
+func parseOptions(name string, args []string) (libify.Options, func(), error) {
+	var options libify.Options
+	closer := func() {}
+
+	fs := flag.NewFlagSet("libify "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: libify %s [flags] <path>...\n\nFlags:\n", name)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&options.RootPath, "root", "", "package path of the module root (default: module path of the nearest go.mod)")
+	fs.StringVar(&options.RootDir, "dir", "", "dir of the module root (default: dir of the nearest go.mod)")
+	fs.BoolVar(&options.Tests, "tests", false, "also convert test files")
+	fs.BoolVar(&options.Library, "library", false, "convert library packages: add a NewInstance constructor instead of renaming main")
+	fs.StringVar(&options.Shim, "shim", "", "in library mode, generate a compatibility package with this path that has the original API (exported vars become funcs returning a pointer)")
+	fs.BoolVar(&options.IsolationTests, "isolation", false, "add a test to each package that checks two package states don't share any state")
+	style := fs.String("style", "param", "how converted functions get the package state: param (first parameter) or method (receiver)")
+	verbosity := fs.String("v", "normal", "verbosity of progress output: silent, quiet, normal or verbose")
+	out := fs.String("out", "", "write progress output to this file (default: stdout)")
+	events := fs.String("events", "", "write every progress event as a JSON line to this file")
+	if err := fs.Parse(args); err != nil {
+		return options, closer, err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch *verbosity {
+	case "silent":
+		options.Verbosity = libify.Silent
+	case "quiet":
+		options.Verbosity = libify.Quiet
+	case "normal":
+		options.Verbosity = libify.Normal
+	case "verbose":
+		options.Verbosity = libify.Verbose
+	default:
+		return options, closer, errors.Errorf("unknown verbosity %q", *verbosity)
+	}
+
+	switch *style {
+	case "param":
+		options.Style = libify.ParamStyle
+	case "method":
+		options.Style = libify.MethodStyle
+	default:
+		return options, closer, errors.Errorf("unknown style %q", *style)
+	}
+
+	var files []io.Closer
+	closer = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	options.Out = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return options, closer, errors.WithStack(err)
+		}
+		files = append(files, f)
+		options.Out = f
+	}
+	if *events != "" {
+		f, err := os.Create(*events)
+		if err != nil {
+			return options, closer, errors.WithStack(err)
+		}
+		files = append(files, f)
+		enc := json.NewEncoder(f)
+		options.Observer = func(e libify.Event) {
+			enc.Encode(e)
+		}
+	}
+
+	if options.RootPath == "" || options.RootDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return options, closer, errors.WithStack(err)
+		}
+		modDir, modPath, err := findModule(wd)
+		if err != nil {
+			return options, closer, err
+		}
+		if options.RootPath == "" {
+			options.RootPath = modPath
+		}
+		if options.RootDir == "" {
+			options.RootDir = modDir
+		}
+	}
+	absDir, err := filepath.Abs(options.RootDir)
+	if err != nil {
+		return options, closer, errors.WithStack(err)
+	}
+	options.RootDir = absDir
+
+	for i, arg := range fs.Args() {
+		p, err := packagePath(arg, options.RootPath, options.RootDir)
+		if err != nil {
+			return options, closer, err
+		}
+		if i == 0 {
+			options.Path = p
+		} else {
+			options.Paths = append(options.Paths, p)
+		}
+	}
+	return options, closer, nil
+}
+
+// findModule finds the nearest go.mod in dir or its parents, and returns the dir and module path.
+func findModule(dir string) (string, string, error) {
+	for {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			for _, line := range strings.Split(string(b), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) == 2 && fields[0] == "module" {
+					return dir, strings.Trim(fields[1], "\"`"), nil
+				}
+			}
+			return "", "", errors.Errorf("no module directive in %s", filepath.Join(dir, "go.mod"))
+		}
+		if !os.IsNotExist(err) {
+			return "", "", errors.WithStack(err)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", errors.New("can't find go.mod - use -root and -dir to specify the module")
+		}
+		dir = parent
+	}
+}
+
+// packagePath converts arg to a package path. Args starting with "." or that are absolute are
+// treated as dirs, which must be inside the module root dir.
+func packagePath(arg, rootPath, rootDir string) (string, error) {
+	if !strings.HasPrefix(arg, ".") && !filepath.IsAbs(arg) {
+		return arg, nil
+	}
+	dir, err := filepath.Abs(arg)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	rel, err := filepath.Rel(rootDir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("%s is not inside the module root %s", arg, rootDir)
+	}
+	return path.Join(rootPath, filepath.ToSlash(rel)), nil
+}
+
+func run(ctx context.Context, options libify.Options) error {
+	return libify.Main(ctx, options)
+}
+
+func analyze(ctx context.Context, options libify.Options) error {
+	findings, err := libify.Preflight(ctx, options)
+	if err != nil {
+		return err
+	}
+	var errs int
+	for _, f := range findings {
+		fmt.Println(f)
+		if f.Severity == libify.Error {
+			errs++
+		}
+	}
+	if errs > 0 {
+		return errors.Errorf("found %d unsupported constructs", errs)
+	}
+	return nil
+}
+
+func diff(ctx context.Context, options libify.Options) error {
+	dir, err := ioutil.TempDir("", "libify")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		if err := libgo.Copy(options.RootDir, filepath.Join(dir, name)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	options.RootDir = filepath.Join(dir, "b")
+	if err := libify.Main(ctx, options); err != nil {
+		return err
+	}
+	cmd := exec.Command("diff", "-ruN", "-x", ".git", "a", "b")
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		// diff exits with 1 if there are differences
+		if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func verify(ctx context.Context, options libify.Options) error {
+	dir, err := ioutil.TempDir("", "libify")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := libgo.Copy(options.RootDir, dir); err != nil {
+		return errors.WithStack(err)
+	}
+	options.RootDir = dir
+	if err := libify.Main(ctx, options); err != nil {
+		return err
+	}
+	// the converted command has no main func so can't be linked, but vet type checks every package
+	steps := [][]string{
+		{"go", "vet", "./..."},
+	}
+	if options.Tests {
+		steps = append(steps, []string{"go", "test", "./..."})
+	}
+	progress := libify.Progress{Out: options.Out, Verbosity: options.Verbosity, Observer: options.Observer}
+	for _, step := range steps {
+		finished := progress.Phase(strings.Join(step, " "))
+		cmd := exec.Command(step[0], step[1:]...)
+		cmd.Dir = dir
+		cmd.Stdout = options.Out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Errorf("%s failed: %v", strings.Join(step, " "), err)
+		}
+		finished()
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package libify
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/pkg/errors"
+)
+
+// Diagnostic is a problem found while converting a package
+type Diagnostic struct {
+	Pos     token.Position // position of the offending node, if known
+	Pass    string         // name of the pass that found the problem
+	Ident   string         // offending identifier, if any
+	Message string
+}
+
+func (d Diagnostic) Error() string {
+	var parts []string
+	if d.Pos.IsValid() {
+		parts = append(parts, d.Pos.String())
+	}
+	if d.Pass != "" {
+		parts = append(parts, d.Pass)
+	}
+	if d.Ident != "" {
+		parts = append(parts, d.Ident)
+	}
+	parts = append(parts, d.Message)
+	return strings.Join(parts, ": ")
+}
+
+// Diagnostics is a list of diagnostics. Main returns all the diagnostics from all packages together
+// as a Diagnostics error.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	lines := []string{fmt.Sprintf("libify found %d problems:", len(d))}
+	for _, diagnostic := range d {
+		lines = append(lines, diagnostic.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type pass struct {
+	name string
+	run  func() error
+}
+
+// runPasses runs the passes in order. Panics are converted to diagnostics, which include the stack
+// of the panic. After all passes have run, any diagnostics are returned as a Diagnostics error,
+// sorted by position.
+func (l *libifier) runPasses(passes ...pass) error {
+	for _, p := range passes {
+		if err := l.runPass(p); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if len(l.diagnostics) > 0 {
+		sort.SliceStable(l.diagnostics, func(i, j int) bool {
+			pi, pj := l.diagnostics[i].Pos, l.diagnostics[j].Pos
+			if pi.Filename != pj.Filename {
+				return pi.Filename < pj.Filename
+			}
+			if pi.Line != pj.Line {
+				return pi.Line < pj.Line
+			}
+			return pi.Column < pj.Column
+		})
+		return l.diagnostics
+	}
+	return nil
+}
+
+func (l *libifier) runPass(p pass) (err error) {
+	defer l.progress().Phase(p.name)()
+	l.pass = p.name
+	defer func() {
+		l.pass = ""
+		if r := recover(); r != nil {
+			l.diagnostics = append(l.diagnostics, Diagnostic{
+				Pass:    p.name,
+				Message: fmt.Sprintf("panic: %v\n%s", r, debug.Stack()),
+			})
+		}
+	}()
+	return p.run()
+}
+
+// errorf adds a diagnostic for the current pass. The position is found from the ast node that n was
+// decorated from.
+func (l *libifier) errorf(lp *libifyPkg, n dst.Node, ident, format string, args ...interface{}) {
+	d := Diagnostic{
+		Pass:    l.pass,
+		Ident:   ident,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if a, ok := lp.pkg.Decorator.Ast.Nodes[n]; ok && a != nil {
+		d.Pos = lp.pkg.Fset.Position(a.Pos())
+	}
+	l.diagnostics = append(l.diagnostics, d)
+}
+
+// def finds the object defined by id, adding a diagnostic if it can't be found.
+func (l *libifier) def(lp *libifyPkg, id *dst.Ident) types.Object {
+	a, ok := lp.pkg.Decorator.Ast.Nodes[id].(*ast.Ident)
+	if !ok {
+		l.errorf(lp, id, id.Name, "can't find ast node")
+		return nil
+	}
+	ob, ok := lp.pkg.TypesInfo.Defs[a]
+	if !ok || ob == nil {
+		l.errorf(lp, id, id.Name, "can't find %s in defs", id.Name)
+		return nil
+	}
+	return ob
+}
@@ -0,0 +1,347 @@
+package libify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestEquivalence(t *testing.T) {
+	src := map[string]string{
+		"go.mod": "module root\n\ngo 1.16",
+		"counter/counter.go": `package counter
+
+			var n int
+
+			func Next() int {
+				n++
+				return n
+			}
+		`,
+		"cmd/main.go": `package main
+
+			import (
+				"bufio"
+				"fmt"
+				"os"
+				"strings"
+
+				"root/counter"
+			)
+
+			var prefix = os.Getenv("PREFIX")
+
+			func main() {
+				if len(os.Args) == 1 {
+					s := bufio.NewScanner(os.Stdin)
+					for s.Scan() {
+						fmt.Println(prefix, counter.Next(), strings.ToUpper(s.Text()))
+					}
+					return
+				}
+				for _, arg := range os.Args[1:] {
+					if arg == "fail" {
+						fmt.Fprintln(os.Stderr, prefix, counter.Next(), "failed")
+						os.Exit(3)
+					}
+					fmt.Println(prefix, counter.Next(), arg)
+				}
+			}
+		`,
+	}
+	cases := []equivalenceCase{
+		{name: "args", args: []string{"a", "b", "c"}},
+		{name: "env", args: []string{"a"}, env: []string{"PREFIX=foo"}},
+		{name: "stdin", stdin: "a\nb\n"},
+		{name: "exit", args: []string{"a", "fail", "b"}},
+	}
+	t.Run("param", func(t *testing.T) {
+		checkEquivalence(t, src, "root", "root/cmd", ParamStyle, cases)
+	})
+	t.Run("method", func(t *testing.T) {
+		checkEquivalence(t, src, "root", "root/cmd", MethodStyle, cases)
+	})
+}
+
+// TestEquivalencePreset runs a libified command with a ProgramState preset that has the counter
+// package state replaced. The counter must be the preset one (so it continues from where the driver
+// left it) and must not be created again (the initializer prints once per package state).
+func TestEquivalencePreset(t *testing.T) {
+	src := map[string]string{
+		"go.mod": "module root\n\ngo 1.16",
+		"counter/counter.go": `package counter
+
+			import "fmt"
+
+			var n = func() int {
+				fmt.Println("counter created")
+				return 0
+			}()
+
+			func Next() int {
+				n++
+				return n
+			}
+		`,
+		"cmd/main.go": `package main
+
+			import (
+				"fmt"
+
+				"root/counter"
+			)
+
+			func main() {
+				fmt.Println(counter.Next())
+				fmt.Println(counter.Next())
+			}
+		`,
+	}
+	for _, test := range []struct {
+		name  string
+		style Style
+	}{{"param", ParamStyle}, {"method", MethodStyle}} {
+		style := test.style
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := TempDir(src)
+			defer os.RemoveAll(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := Options{
+				Path:     "root/cmd",
+				RootPath: "root",
+				RootDir:  dir,
+				Out:      ioutil.Discard,
+				Style:    style,
+			}
+			if err := Main(context.Background(), options); err != nil {
+				t.Fatal(err)
+			}
+			next, callMain := "counter.Next(c)", "Main(state.Cmd)"
+			if style == MethodStyle {
+				next, callMain = "c.Next()", "state.Cmd.Main()"
+			}
+			driver := fmt.Sprintf(`package main
+
+				import "root/counter"
+
+				func main() {
+					c := counter.NewPackageState()
+					%s
+					state := NewProgramState(&ProgramState{Counter: c})
+					if state.Counter != c {
+						panic("the preset counter state was replaced")
+					}
+					%s
+				}
+			`, next, callMain)
+			if err := AddToDir(dir, map[string]string{"cmd/libify-driver.go": driver}); err != nil {
+				t.Fatal(err)
+			}
+			bin, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(bin)
+			buildCommand(t, dir, "root", "root/cmd", filepath.Join(bin, "lib"))
+			found := runCommand(t, filepath.Join(bin, "lib"), equivalenceCase{}, nil)
+			compare(t, fmt.Sprintf("%#v", equivalenceResult{stdout: "counter created\n2\n3\n"}), fmt.Sprintf("%#v", found))
+		})
+	}
+}
+
+type equivalenceCase struct {
+	name  string
+	args  []string
+	stdin string
+	env   []string
+}
+
+type equivalenceResult struct {
+	stdout, stderr string
+	code           int
+}
+
+// checkEquivalence builds the command at path twice: once from the original source, and once
+// after libify (in the given style) with a driver that calls the libified entry point. Each case is run against both
+// binaries and stdout, stderr and exit code are compared. Cases that exit cleanly with no stdin
+// are also run with two libified instances concurrently in the same process, and the output
+// lines must be the original output lines twice over (in any order).
+func checkEquivalence(t *testing.T, src map[string]string, root, path string, style Style, cases []equivalenceCase) {
+	t.Helper()
+
+	bin, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+
+	origDir, err := TempDir(src)
+	defer os.RemoveAll(origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := filepath.Join(bin, "orig")
+	buildCommand(t, origDir, root, path, orig)
+
+	libDir, err := TempDir(src)
+	defer os.RemoveAll(libDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := Options{
+		Path:     path,
+		RootPath: root,
+		RootDir:  libDir,
+		Out:      ioutil.Discard,
+		Style:    style,
+	}
+	if err := Main(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	if err := addDriver(libDir, root, path, style); err != nil {
+		t.Fatal(err)
+	}
+	lib := filepath.Join(bin, "lib")
+	buildCommand(t, libDir, root, path, lib)
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			expect := runCommand(t, orig, c, nil)
+			found := runCommand(t, lib, c, nil)
+			compare(t, fmt.Sprintf("%#v", expect), fmt.Sprintf("%#v", found))
+			if expect.code != 0 || c.stdin != "" {
+				return
+			}
+			t.Run("concurrent", func(t *testing.T) {
+				found := runCommand(t, lib, c, []string{"LIBIFY_DRIVER_INSTANCES=2"})
+				compare(t, doubleLines(expect.stdout), sortLines(found.stdout))
+				compare(t, doubleLines(expect.stderr), sortLines(found.stderr))
+				compare(t, "0", fmt.Sprint(found.code))
+			})
+		})
+	}
+}
+
+func buildCommand(t *testing.T, dir, root, path, out string) {
+	t.Helper()
+	cmd := exec.Command("go", "build", "-o", out, "./"+strings.TrimPrefix(strings.TrimPrefix(path, root), "/"))
+	cmd.Dir = dir
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %v\n%s", path, err, b)
+	}
+}
+
+func runCommand(t *testing.T, bin string, c equivalenceCase, env []string) equivalenceResult {
+	t.Helper()
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command(bin, c.args...)
+	cmd.Env = append(append(os.Environ(), c.env...), env...)
+	cmd.Stdin = strings.NewReader(c.stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	var code int
+	if err := cmd.Run(); err != nil {
+		exit, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		code = exit.ExitCode()
+	}
+	return equivalenceResult{stdout: stdout.String(), stderr: stderr.String(), code: code}
+}
+
+func sortLines(s string) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func doubleLines(s string) string {
+	if s == "" {
+		return ""
+	}
+	return sortLines(s + s)
+}
+
+// addDriver adds a file to the libified main package at path with a main function that gets the
+// package state from the generated NewProgramState and calls Main. If LIBIFY_DRIVER_INSTANCES=2,
+// two instances are run concurrently.
+func addDriver(dir, root, path string, style Style) error {
+	cfg := &packages.Config{
+		Mode: packages.LoadSyntax,
+		Dir:  dir,
+	}
+	pkgs, err := packages.Load(cfg, path)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) != 1 || len(pkgs[0].Errors) > 0 {
+		return fmt.Errorf("loading %s: %v", path, pkgs[0].Errors)
+	}
+
+	// find the field of ProgramState that has the package state of the command
+	ob, ok := pkgs[0].Types.Scope().Lookup("NewProgramState").(*types.Func)
+	if !ok {
+		return fmt.Errorf("can't find NewProgramState in %s", path)
+	}
+	programState := ob.Type().(*types.Signature).Results().At(0).Type().(*types.Pointer).Elem().Underlying().(*types.Struct)
+	var field string
+	for i := 0; i < programState.NumFields(); i++ {
+		named := programState.Field(i).Type().(*types.Pointer).Elem().(*types.Named)
+		if named.Obj().Pkg() == pkgs[0].Types {
+			field = programState.Field(i).Name()
+		}
+	}
+	if field == "" {
+		return fmt.Errorf("can't find the package state of %s in ProgramState", path)
+	}
+
+	callMain := "Main(newDriverState())"
+	if style == MethodStyle {
+		callMain = "newDriverState().Main()"
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "package main")
+	fmt.Fprintln(buf, "import (")
+	fmt.Fprintln(buf, `"os"`)
+	fmt.Fprintln(buf, `"sync"`)
+	fmt.Fprintln(buf, ")")
+	fmt.Fprintf(buf, `func main() {
+		if os.Getenv("LIBIFY_DRIVER_INSTANCES") != "2" {
+			%[1]s
+			return
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				%[1]s
+			}()
+		}
+		wg.Wait()
+	}
+`, callMain)
+	fmt.Fprintln(buf, "func newDriverState() *PackageState {")
+	fmt.Fprintf(buf, "return NewProgramState(nil).%s\n", field)
+	fmt.Fprintln(buf, "}")
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+	return AddToDir(dir, map[string]string{
+		filepath.ToSlash(filepath.Join(rel, "libify-driver.go")): buf.String(),
+	})
+}
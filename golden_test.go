@@ -0,0 +1,202 @@
+package libify
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/txtar"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// TestGolden runs Main for every testdata/*.txtar archive. Each archive contains:
+//
+// | Section        | Contents                                                        |
+// | (comment)      | description of the case                                         |
+// | options        | "key: value" lines (see parseGoldenOptions)                     |
+// | expect/<fpath> | expected contents of <fpath> in the output dir                  |
+// | error          | expected error (optional - expect files are ignored if present) |
+// | <fpath>        | input files                                                     |
+//
+// The temporary dir in error messages is replaced with $DIR.
+//
+// Run with -update to rewrite the expect/ and error sections with the actual output.
+func TestGolden(t *testing.T) {
+	fpaths, err := filepath.Glob(filepath.Join("testdata", "*.txtar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fpath := range fpaths {
+		fpath := fpath
+		name := strings.TrimSuffix(filepath.Base(fpath), ".txtar")
+		t.Run(name, func(t *testing.T) {
+			runGolden(t, fpath)
+		})
+	}
+}
+
+type goldenCase struct {
+	archive *txtar.Archive
+	options Options
+	src     map[string]string
+	expect  map[string]string
+	err     *string
+}
+
+func runGolden(t *testing.T, fpath string) {
+	c, err := parseGolden(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := TempDir(c.src)
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := c.options
+	options.RootDir = dir
+	options.Out = ioutil.Discard
+
+	var errText string
+	mainErr := Main(context.Background(), options)
+	if mainErr != nil {
+		// the temporary dir will be different each time
+		errText = strings.ReplaceAll(mainErr.Error(), dir, "$DIR")
+	}
+
+	if *update {
+		if err := updateGolden(fpath, c, readDir(t, dir), errText); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if c.err != nil {
+		if mainErr == nil {
+			t.Fatalf("expected error containing %q", *c.err)
+		}
+		if !strings.Contains(errText, *c.err) {
+			t.Fatalf("\nexpect error: %q\nfound error : %q", *c.err, errText)
+		}
+		return
+	}
+	if mainErr != nil {
+		t.Fatal(mainErr)
+	}
+	compareDir(t, dir, c.expect)
+}
+
+func parseGolden(fpath string) (*goldenCase, error) {
+	a, err := txtar.ParseFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	c := &goldenCase{
+		archive: a,
+		src:     map[string]string{},
+		expect:  map[string]string{},
+	}
+	for _, f := range a.Files {
+		switch {
+		case f.Name == "options":
+			if err := parseGoldenOptions(string(f.Data), &c.options); err != nil {
+				return nil, err
+			}
+		case f.Name == "error":
+			e := strings.TrimSpace(string(f.Data))
+			c.err = &e
+		case strings.HasPrefix(f.Name, "expect/"):
+			c.expect[strings.TrimPrefix(f.Name, "expect/")] = string(f.Data)
+		default:
+			c.src[f.Name] = string(f.Data)
+		}
+	}
+	return c, nil
+}
+
+func parseGoldenOptions(s string, options *Options) error {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid options line %q", line)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "path":
+			options.Path = value
+		case "paths":
+			options.Paths = strings.Fields(value)
+		case "root":
+			options.RootPath = value
+		case "tests":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for tests: %q", value)
+			}
+			options.Tests = b
+		case "library":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for library: %q", value)
+			}
+			options.Library = b
+		case "shim":
+			options.Shim = value
+		case "isolation":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for isolation: %q", value)
+			}
+			options.IsolationTests = b
+		case "style":
+			switch value {
+			case "param":
+				options.Style = ParamStyle
+			case "method":
+				options.Style = MethodStyle
+			default:
+				return fmt.Errorf("invalid value for style: %q", value)
+			}
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return nil
+}
+
+func updateGolden(fpath string, c *goldenCase, found map[string]string, errText string) error {
+	a := &txtar.Archive{Comment: c.archive.Comment}
+	for _, f := range c.archive.Files {
+		if f.Name == "error" || strings.HasPrefix(f.Name, "expect/") {
+			continue
+		}
+		a.Files = append(a.Files, f)
+	}
+	if errText != "" {
+		a.Files = append(a.Files, txtar.File{Name: "error", Data: []byte(errText + "\n")})
+	} else {
+		var keys []string
+		for k := range found {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			a.Files = append(a.Files, txtar.File{Name: "expect/" + k, Data: []byte(found[k])})
+		}
+	}
+	return ioutil.WriteFile(fpath, txtar.Format(a), 0666)
+}
@@ -0,0 +1,338 @@
+package libify
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"go/types"
+	"sort"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/goast"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/pkg/errors"
+)
+
+// sortStateGraph returns lp and all the in-scope packages it depends on (directly or indirectly)
+// in dependency order, so each package is after all of its imports.
+func (l *libifier) sortStateGraph(lp *libifyPkg) []*libifyPkg {
+	var out []*libifyPkg
+	done := map[*libifyPkg]bool{}
+	var visit func(*libifyPkg)
+	visit = func(p *libifyPkg) {
+		if done[p] {
+			return
+		}
+		done[p] = true
+		for _, imp := range l.sortAndFilterImports(p) {
+			visit(imp)
+		}
+		out = append(out, p)
+	}
+	visit(lp)
+	return out
+}
+
+// generateStateGraph generates statements that construct the package state of lp and all the
+// in-scope packages it depends on, each exactly once. The returned expression is the package state
+// of lp. The statements are intended to be added to a function in the package with path "from".
+func (l *libifier) generateStateGraph(lp *libifyPkg, from string) ([]dst.Stmt, dst.Expr) {
+	u := uniqueNamePicker{}
+	names := map[*libifyPkg]string{}
+	call := func(p *libifyPkg) *dst.CallExpr {
+		var args []dst.Expr
+		for _, imp := range l.sortAndFilterImports(p) {
+			args = append(args, dst.NewIdent(names[imp]))
+		}
+		fun := &dst.Ident{Name: "NewPackageState"}
+		if p.pathNoVendor != from {
+			fun.Path = p.pathNoVendor
+		}
+		return &dst.CallExpr{Fun: fun, Args: args}
+	}
+	var stmts []dst.Stmt
+	graph := l.sortStateGraph(lp)
+	for _, p := range graph[:len(graph)-1] {
+		names[p] = u.pick(fmt.Sprintf("%sPackageState", p.pkg.Name))
+		stmts = append(stmts, &dst.AssignStmt{
+			Lhs:  []dst.Expr{dst.NewIdent(names[p])},
+			Tok:  token.DEFINE,
+			Rhs:  []dst.Expr{call(p)},
+			Decs: dst.AssignStmtDecorations{NodeDecs: dst.NodeDecs{Before: dst.NewLine}},
+		})
+	}
+	return stmts, call(lp)
+}
+
+func (l *libifier) addIsolationTests() error {
+	for _, lp := range l.packages {
+		if lp.test {
+			continue
+		}
+		fpath, ok := l.newFilename(lp, "libify_isolation_test.go")
+		if !ok {
+			continue
+		}
+		u := uniqueNamePicker{}
+		for _, name := range lp.pkg.Types.Scope().Names() {
+			u[name] = true
+		}
+		names := isolationNames{
+			state:      u.pick("newLibifyIsolationState"),
+			test:       u.pick("TestLibifyIsolation"),
+			concurrent: u.pick("TestLibifyIsolationConcurrent"),
+		}
+		f, err := l.generateIsolationTestFile(lp, names)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		stmts, result := l.generateStateGraph(lp, lp.pathNoVendor)
+		stmts = append(stmts, &dst.ReturnStmt{
+			Results: []dst.Expr{result},
+			Decs:    dst.ReturnStmtDecorations{NodeDecs: dst.NodeDecs{Before: dst.NewLine}},
+		})
+		f.Decls = append(f.Decls, &dst.FuncDecl{
+			Name: dst.NewIdent(names.state),
+			Type: &dst.FuncType{
+				Params: &dst.FieldList{},
+				Results: &dst.FieldList{
+					List: []*dst.Field{{Type: &dst.StarExpr{X: dst.NewIdent("PackageState")}}},
+				},
+			},
+			Body: &dst.BlockStmt{List: stmts},
+			Decs: dst.FuncDeclDecorations{NodeDecs: dst.NodeDecs{Before: dst.EmptyLine}},
+		})
+
+		lp.pkg.Syntax = append(lp.pkg.Syntax, f)
+		lp.pkg.Decorator.Filenames[f] = fpath
+	}
+	return nil
+}
+
+// isolationNames are the names of the generated isolation test funcs, picked so they don't collide
+// with anything in the package.
+type isolationNames struct {
+	state      string // newLibifyIsolationState
+	test       string // TestLibifyIsolation
+	concurrent string // TestLibifyIsolationConcurrent
+}
+
+// generateIsolationTestFile generates the tests that check two package states created by
+// newLibifyIsolationState don't share any state. Every package level var field is checked for
+// shared memory, then mutated in one instance (see libifyIsolationMutate) and compared in the
+// other.
+func (l *libifier) generateIsolationTestFile(lp *libifyPkg, names isolationNames) (*dst.File, error) {
+
+	var vars []*types.Var
+	for ob := range lp.packageLevelVarObject {
+		vars = append(vars, ob.(*types.Var))
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name() < vars[j].Name() })
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "package %s\n\n", lp.pkg.Name)
+	fmt.Fprint(buf, "import (\n\"fmt\"\n\"reflect\"\n\"sort\"\n\"sync\"\n\"testing\"\n)\n\n")
+	fmt.Fprintf(buf, isolationTestDoc, names.test)
+	fmt.Fprintf(buf, "func %s(t *testing.T) {\n", names.test)
+	fmt.Fprintf(buf, "p1 := %s()\n", names.state)
+	fmt.Fprintf(buf, "p2 := %s()\n", names.state)
+	if len(vars) > 0 {
+		fmt.Fprint(buf, "var before string\n")
+	} else {
+		// there's nothing to compare, but the states are still created
+		fmt.Fprint(buf, "_, _ = p1, p2\n")
+	}
+	for _, v := range vars {
+		fmt.Fprintf(buf, "if libifyIsolationShared(reflect.ValueOf(p1.%[1]s), reflect.ValueOf(p2.%[1]s)) {\nt.Error(\"%[1]s: memory shared between instances\")\n}\n", v.Name())
+		fmt.Fprintf(buf, "before = libifyIsolationDump(p2.%s)\n", v.Name())
+		fmt.Fprintf(buf, "if libifyIsolationMutate(&p1.%[1]s) && libifyIsolationDump(p2.%[1]s) != before {\nt.Error(\"%[1]s: mutation affected other instance\")\n}\n", v.Name())
+	}
+	fmt.Fprint(buf, "}\n\n")
+	fmt.Fprintf(buf, isolationConcurrentTestSource, names.concurrent, names.state)
+	fmt.Fprint(buf, isolationTestSource)
+
+	d := decorator.NewDecoratorWithImports(token.NewFileSet(), lp.pathNoVendor, goast.WithResolver(guess.New()))
+	f, err := d.Parse(buf.Bytes())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
+
+const isolationTestDoc = `// %s checks that two instances don't share the package level vars. Each var is
+// checked for shared memory, then changed in one instance and compared in the other. Basic values
+// are changed, maps get an element added or removed, slices get their first element changed and an
+// element appended, and pointers, interfaces holding pointers, structs and arrays get the first
+// value they refer to that can be changed changed. Not covered: funcs, chans and unsafe pointers,
+// nil maps and pointers, values only reachable through unexported fields of other packages' types,
+// and values nested more than 10 levels deep. These are only checked for shared memory.
+`
+
+const isolationConcurrentTestSource = `func %s(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			%s()
+		}()
+	}
+	wg.Wait()
+}
+
+`
+
+const isolationTestSource = `// libifyIsolationShared returns true if a and b (values of the same type) share memory.
+func libifyIsolationShared(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Ptr:
+		return !a.IsNil() && a.Type().Elem().Size() > 0 && a.Pointer() == b.Pointer()
+	case reflect.Map, reflect.Chan, reflect.UnsafePointer:
+		return !a.IsNil() && a.Pointer() == b.Pointer()
+	case reflect.Slice:
+		return a.Cap() > 0 && a.Type().Elem().Size() > 0 && a.Pointer() == b.Pointer()
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if libifyIsolationShared(a.Index(i), b.Index(i)) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if libifyIsolationShared(a.Field(i), b.Field(i)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// libifyIsolationMutate changes the value ptr points to, and returns false if nothing could be
+// changed.
+func libifyIsolationMutate(ptr interface{}) bool {
+	return libifyIsolationMutateValue(reflect.ValueOf(ptr).Elem(), 0)
+}
+
+func libifyIsolationMutateValue(v reflect.Value, depth int) bool {
+	if depth > 10 {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.CanSet() {
+			v.SetBool(!v.Bool())
+			return true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.CanSet() {
+			v.SetInt(v.Int() + 1)
+			return true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.CanSet() {
+			v.SetUint(v.Uint() + 1)
+			return true
+		}
+	case reflect.Float32, reflect.Float64:
+		if v.CanSet() {
+			v.SetFloat(v.Float() + 1)
+			return true
+		}
+	case reflect.Complex64, reflect.Complex128:
+		if v.CanSet() {
+			v.SetComplex(v.Complex() + 1)
+			return true
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(v.String() + "libify")
+			return true
+		}
+	case reflect.Map:
+		if v.IsNil() || !v.CanInterface() {
+			return false
+		}
+		if keys := v.MapKeys(); len(keys) > 0 {
+			v.SetMapIndex(keys[0], reflect.Value{})
+		} else {
+			v.SetMapIndex(reflect.Zero(v.Type().Key()), reflect.Zero(v.Type().Elem()))
+		}
+		return true
+	case reflect.Slice:
+		if !v.CanSet() {
+			return false
+		}
+		mutated := v.Len() > 0 && libifyIsolationMutateValue(v.Index(0), depth+1)
+		// appending writes to the shared array if there's spare capacity
+		e := reflect.New(v.Type().Elem()).Elem()
+		if libifyIsolationMutateValue(e, depth+1) {
+			v.Set(reflect.Append(v, e))
+			mutated = true
+		}
+		return mutated
+	case reflect.Ptr:
+		return !v.IsNil() && libifyIsolationMutateValue(v.Elem(), depth+1)
+	case reflect.Interface:
+		return !v.IsNil() && v.Elem().Kind() == reflect.Ptr && libifyIsolationMutateValue(v.Elem(), depth+1)
+	case reflect.Array:
+		return v.Len() > 0 && libifyIsolationMutateValue(v.Index(0), depth+1)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if libifyIsolationMutateValue(v.Field(i), depth+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// libifyIsolationDump describes x and everything it refers to, so the description changes when any
+// of it changes. Slices are described up to their capacity, so appends to a shared array are seen.
+func libifyIsolationDump(x interface{}) string {
+	return libifyIsolationDumpValue(reflect.ValueOf(x), map[uintptr]bool{})
+}
+
+func libifyIsolationDumpValue(v reflect.Value, seen map[uintptr]bool) string {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || seen[v.Pointer()] {
+			return fmt.Sprint(v.Pointer())
+		}
+		seen[v.Pointer()] = true
+		return "&" + libifyIsolationDumpValue(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return "nil"
+		}
+		return libifyIsolationDumpValue(v.Elem(), seen)
+	case reflect.Map:
+		var entries []string
+		iter := v.MapRange()
+		for iter.Next() {
+			entries = append(entries, libifyIsolationDumpValue(iter.Key(), seen)+":"+libifyIsolationDumpValue(iter.Value(), seen))
+		}
+		sort.Strings(entries)
+		return fmt.Sprint(entries)
+	case reflect.Slice:
+		v = v.Slice(0, v.Cap())
+		fallthrough
+	case reflect.Array:
+		var elems []string
+		for i := 0; i < v.Len(); i++ {
+			elems = append(elems, libifyIsolationDumpValue(v.Index(i), seen))
+		}
+		return fmt.Sprint(elems)
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < v.NumField(); i++ {
+			fields = append(fields, libifyIsolationDumpValue(v.Field(i), seen))
+		}
+		return fmt.Sprint(fields)
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return fmt.Sprint(v.Pointer())
+	}
+	return fmt.Sprint(v)
+}
+`
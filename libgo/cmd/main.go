@@ -2,47 +2,164 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"go/build"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/dave/libify"
 	"github.com/dave/libify/libgo"
 )
 
 func main() {
-	if err := libgo.Main(context.Background(), linkOptions()); err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+	configFile := flag.String("config", "libgo.json", "config file (ignored if it doesn't exist)")
+	targets := flag.String("target", "", "comma separated targets to extract, from the config or the built in presets, or \"all\" for every target in the config")
+	list := flag.Bool("list", false, "list the targets and presets, then exit")
+	rootPath := flag.String("root", "", "override the package path of the module root")
+	rootDir := flag.String("dir", "", "override the dir of the module root (default: GOPATH/src/<root>)")
+	goroot := flag.String("goroot", "", "override the Go source tree to extract from")
+	include := flag.String("include", "", "override the comma separated patterns of packages to extract")
+	exclude := flag.String("exclude", "", "override the comma separated patterns of packages to leave out")
+	authorName := flag.String("author-name", "", "override the author of the commits")
+	authorEmail := flag.String("author-email", "", "override the email of the author of the commits")
+	discover := flag.Bool("discover", false, "run the tests of the extracted packages, and add the tests that fail only after extraction to disable_tests in the config")
+	upgrade := flag.Bool("upgrade", false, "extract onto the pristine branch, then merge it into the current branch (needs git in PATH)")
+	init := flag.Bool("init", false, "override the init option")
+	tests := flag.Bool("tests", false, "override the tests option")
+	force := flag.Bool("force", false, "clear the root dir on init even if it wasn't created by libgo")
+	verbose := flag.Bool("v", false, "print per-package counts")
+	quiet := flag.Bool("q", false, "print only warnings")
+	flag.Parse()
+
+	if *verbose && *quiet {
+		fmt.Println("-v and -q can't be used together")
+		os.Exit(2)
 	}
-}
 
-func compileOptions() libgo.Options {
-	return libgo.Options{
-		From:     "cmd/compile",
-		RootPath: "github.com/dave/compile",
-		RootDir:  filepath.Join(build.Default.GOPATH, "src", "github.com/dave/compile"),
-		DisableTests: map[string]map[string]bool{
-			"cmd/compile_test":             {"TestFormats": true},
-			"cmd/compile/internal/gc_test": {"TestBuiltin": true},
-		},
-		Init:  false,
-		Tests: false, // TODO: adding test packages break things.
+	var config *libgo.Config
+	if _, err := os.Stat(*configFile); err == nil {
+		config, err = libgo.LoadConfig(*configFile)
+		if err != nil {
+			fmt.Printf("%+v", err)
+			os.Exit(1)
+		}
 	}
-}
 
-func linkOptions() libgo.Options {
-	return libgo.Options{
-		From:     "cmd/link",
-		RootPath: "github.com/dave/link",
-		RootDir:  filepath.Join(build.Default.GOPATH, "src", "github.com/dave/link"),
-		DisableTests: map[string]map[string]bool{
-			"cmd/link": {
-				"TestDWARF":    true,
-				"TestDWARFiOS": true,
-			},
-		},
-		Init:  false,
-		Tests: false, // TODO: adding test packages break things.
+	if *list {
+		if config != nil {
+			fmt.Println("targets:", strings.Join(config.Names(), " "))
+		}
+		var presets []string
+		for name := range libgo.Presets {
+			presets = append(presets, name)
+		}
+		sort.Strings(presets)
+		fmt.Println("presets:", strings.Join(presets, " "))
+		return
+	}
+
+	var names []string
+	switch *targets {
+	case "":
+		flag.Usage()
+		os.Exit(2)
+	case "all":
+		if config == nil {
+			fmt.Printf("no config file %s\n", *configFile)
+			os.Exit(2)
+		}
+		names = config.Names()
+	default:
+		names = strings.Split(*targets, ",")
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, name := range names {
+		options, err := config.Options(name)
+		if err != nil {
+			fmt.Printf("%+v", err)
+			os.Exit(1)
+		}
+		if set["root"] {
+			options.RootPath = *rootPath
+		}
+		if set["dir"] {
+			options.RootDir = *rootDir
+		}
+		if options.RootDir == "" && options.RootPath != "" {
+			options.RootDir = filepath.Join(build.Default.GOPATH, "src", options.RootPath)
+		}
+		if set["goroot"] {
+			options.Goroot = *goroot
+		}
+		if set["include"] {
+			options.Include = strings.Split(*include, ",")
+		}
+		if set["exclude"] {
+			options.Exclude = strings.Split(*exclude, ",")
+		}
+		if set["author-name"] {
+			options.AuthorName = *authorName
+		}
+		if set["author-email"] {
+			options.AuthorEmail = *authorEmail
+		}
+		if set["upgrade"] {
+			options.Upgrade = *upgrade
+		}
+		if set["init"] {
+			options.Init = *init
+		}
+		if set["tests"] {
+			options.Tests = *tests
+		}
+		if set["force"] {
+			options.Force = *force
+		}
+		switch {
+		case *verbose:
+			options.Verbosity = libify.Verbose
+		case *quiet:
+			options.Verbosity = libify.Quiet
+		}
+		if *discover {
+			disable, err := libgo.Discover(context.Background(), options)
+			if err != nil {
+				fmt.Printf("%s: %+v", name, err)
+				os.Exit(1)
+			}
+			if config == nil {
+				config = &libgo.Config{}
+			}
+			if config.Targets == nil {
+				config.Targets = map[string]libgo.Target{}
+			}
+			t, ok := config.Targets[name]
+			if !ok {
+				// a preset: the root path is needed to find the extracted tree
+				t = libgo.Target{Preset: name}
+				t.RootPath = options.RootPath
+			}
+			t.DisableTests = disable
+			config.Targets[name] = t
+			if err := config.Save(*configFile); err != nil {
+				fmt.Printf("%s: %+v", name, err)
+				os.Exit(1)
+			}
+			continue
+		}
+		if err := libgo.Main(context.Background(), options); err != nil {
+			if conflict, ok := err.(*libgo.ConflictError); ok {
+				fmt.Printf("%s: %v\nresolve the conflicts and commit to finish the upgrade\n", name, conflict)
+				os.Exit(1)
+			}
+			fmt.Printf("%s: %+v", name, err)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,102 @@
+package libgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dave/libify"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// The phases of an extraction. Each phase is committed separately. The commit message subject is
+// "libgo: <phase>".
+const (
+	phaseCopy         = "copy"
+	phaseImports      = "rewrite imports"
+	phaseDisableTests = "disable tests"
+	phaseLibify       = "libify"
+)
+
+const commitPrefix = "libgo: "
+
+// commit commits all the changes in the root dir. The message records the Go version, the options
+// and the libify version. If there are no changes, no commit is made.
+func (l *libgoer) commit(phase string) error {
+	defer l.progress().Phase("commit " + phase)()
+
+	w, err := l.repo.Worktree()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := w.Add("."); err != nil {
+		return errors.WithStack(err)
+	}
+
+	status, err := w.Status()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if status.IsClean() {
+		return nil
+	}
+
+	options, err := json.Marshal(l.options)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	message := fmt.Sprintf("%s%s\n\ngo-version: %s\nlibify-version: %s\noptions: %s\n", commitPrefix, phase, l.goVersion, libify.Version(), options)
+
+	author := l.author()
+	if _, err := w.Commit(message, &git.CommitOptions{Author: author}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (l *libgoer) author() *object.Signature {
+	s := &object.Signature{
+		Name:  l.options.AuthorName,
+		Email: l.options.AuthorEmail,
+		When:  time.Now(),
+	}
+	if s.Name == "" {
+		s.Name = "libgo"
+	}
+	if s.Email == "" {
+		s.Email = "libgo@localhost"
+	}
+	return s
+}
+
+// isPhaseCommit returns true if the commit was made by libgo for the phase
+func isPhaseCommit(c *object.Commit, phase string) bool {
+	subject := strings.SplitN(c.Message, "\n", 2)[0]
+	return subject == commitPrefix+phase
+}
+
+// lastPhaseCommit returns the most recent commit made by libgo for the phase, following first
+// parents back from the commit with hash from. If there's none, nil is returned.
+func lastPhaseCommit(r *git.Repository, from plumbing.Hash, phase string) (*object.Commit, error) {
+	c, err := r.CommitObject(from)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for {
+		if isPhaseCommit(c, phase) {
+			return c, nil
+		}
+		if c.NumParents() == 0 {
+			return nil, nil
+		}
+		if c, err = r.CommitObject(c.ParentHashes[0]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+}
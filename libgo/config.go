@@ -0,0 +1,155 @@
+package libgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Config is a libgo config file, which describes one or more commands to extract. For example:
+//
+//	{
+//		"targets": {
+//			"compile": {
+//				"preset": "compile",
+//				"root_path": "github.com/foo/compile",
+//				"root_dir": "/home/foo/src/compile",
+//				"tests": true
+//			},
+//			"asm": {
+//				"from": "cmd/asm",
+//				"root_path": "github.com/foo/asm",
+//				"root_dir": "/home/foo/src/asm"
+//			}
+//		}
+//	}
+type Config struct {
+	Targets map[string]Target `json:"targets"`
+}
+
+// Target is a command to extract. If Preset is set, fields that are empty in the target are taken
+// from the named preset.
+type Target struct {
+	Preset string `json:"preset,omitempty"`
+	Options
+}
+
+// Presets are built in targets for the common toolchain commands. RootPath and RootDir must be
+// provided by the config or the caller.
+//
+// Tests is left off in the presets and the example config: the extracted test packages haven't been
+// shown to build for every preset, and package level vars declared in test files stay global, so
+// tests that use them still share state between instances. libify reports an error for test file
+// vars with initializers that use converted vars or funcs. Turn it on per target once "libgo
+// discover" and go test pass for it.
+var Presets = map[string]Options{
+	"compile": {
+		From: "cmd/compile",
+		DisableTests: map[string]map[string]string{
+			"cmd/compile_test":             {"TestFormats": "needs the format strings of the GOROOT compiler"},
+			"cmd/compile/internal/gc_test": {"TestBuiltin": "compares with the builtin declarations generated in GOROOT"},
+		},
+	},
+	"link": {
+		From: "cmd/link",
+		DisableTests: map[string]map[string]string{
+			"cmd/link": {
+				"TestDWARF":    "builds binaries with the GOROOT linker",
+				"TestDWARFiOS": "builds binaries with the GOROOT linker",
+			},
+		},
+	},
+	"asm":     {From: "cmd/asm"},
+	"vet":     {From: "cmd/vet"},
+	"cover":   {From: "cmd/cover"},
+	"pack":    {From: "cmd/pack"},
+	"nm":      {From: "cmd/nm"},
+	"objdump": {From: "cmd/objdump"},
+}
+
+// LoadConfig reads a JSON config file
+func LoadConfig(fpath string) (*Config, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &Config{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", fpath)
+	}
+	return c, nil
+}
+
+// Save writes the config to a JSON file
+func (c *Config) Save(fpath string) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := ioutil.WriteFile(fpath, append(b, '\n'), 0666); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Names returns the names of the targets in the config, sorted
+func (c *Config) Names() []string {
+	var names []string
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Options returns the options for the named target. If the config has no target with that name,
+// the preset with that name is used. c may be nil.
+func (c *Config) Options(name string) (Options, error) {
+	var t Target
+	if c != nil {
+		if found, ok := c.Targets[name]; ok {
+			t = found
+		} else if _, ok := Presets[name]; ok {
+			t.Preset = name
+		} else {
+			return Options{}, errors.Errorf("no target or preset named %q", name)
+		}
+	} else {
+		if _, ok := Presets[name]; !ok {
+			return Options{}, errors.Errorf("no preset named %q", name)
+		}
+		t.Preset = name
+	}
+	options := t.Options
+	if t.Preset != "" {
+		preset, ok := Presets[t.Preset]
+		if !ok {
+			return Options{}, errors.Errorf("target %q: no preset named %q", name, t.Preset)
+		}
+		if options.From == "" {
+			options.From = preset.From
+		}
+		if options.DisableTests == nil {
+			options.DisableTests = preset.DisableTests
+		}
+		if options.Include == nil {
+			options.Include = preset.Include
+		}
+	}
+	return options, nil
+}
+
+// Validate checks the required fields are set
+func (o Options) Validate() error {
+	switch {
+	case o.From == "":
+		return errors.New("from must be set")
+	case o.RootPath == "":
+		return errors.New("root path must be set")
+	case o.RootDir == "":
+		return errors.New("root dir must be set")
+	}
+	return nil
+}
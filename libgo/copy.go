@@ -5,26 +5,71 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-// Copy copies src to dest, doesn't matter if src is a directory or a file
-func Copy(src, dest string) error {
+// Copy copies src to dest, doesn't matter if src is a directory or a file. Files and dirs that match
+// one of the exclude patterns (filepath.Match syntax, matched against the base name and the slash
+// separated path relative to src) are skipped. Mode bits are preserved, apart from owner write on
+// files and owner rwx on dirs being added, so copies of read-only trees (e.g. a GOROOT in the module
+// cache) can be changed and removed. Symlinks are never followed: links that point inside src are
+// copied as relative links, and links that point outside are copied unchanged.
+func Copy(src, dest string, exclude ...string) error {
 	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
-	return copy(src, dest, info)
+	root, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	c := &copier{root: root, exclude: exclude}
+	return c.copy(root, dest, info)
+}
+
+type copier struct {
+	root    string
+	exclude []string
+}
+
+// excluded returns true if the file at src matches one of the exclude patterns
+func (c *copier) excluded(src string) (bool, error) {
+	rel, err := filepath.Rel(c.root, src)
+	if err != nil {
+		return false, err
+	}
+	for _, pattern := range c.exclude {
+		for _, name := range []string{filepath.Base(src), filepath.ToSlash(rel)} {
+			match, err := filepath.Match(pattern, name)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
 }
 
 // copy dispatches copy-funcs according to the mode.
 // Because this "copy" could be called recursively,
 // "info" MUST be given here, NOT nil.
-func copy(src, dest string, info os.FileInfo) error {
+func (c *copier) copy(src, dest string, info os.FileInfo) error {
+	if src != c.root {
+		excluded, err := c.excluded(src)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			return nil
+		}
+	}
 	if info.Mode()&os.ModeSymlink != 0 {
-		return lcopy(src, dest, info)
+		return c.lcopy(src, dest, info)
 	}
 	if info.IsDir() {
-		return dcopy(src, dest, info)
+		return c.dcopy(src, dest, info)
 	}
 	return fcopy(src, dest, info)
 }
@@ -44,7 +89,7 @@ func fcopy(src, dest string, info os.FileInfo) error {
 	}
 	defer f.Close()
 
-	if err = os.Chmod(f.Name(), info.Mode()); err != nil {
+	if err = os.Chmod(f.Name(), info.Mode()|0200); err != nil {
 		return err
 	}
 
@@ -61,9 +106,9 @@ func fcopy(src, dest string, info os.FileInfo) error {
 // dcopy is for a directory,
 // with scanning contents inside the directory
 // and pass everything to "copy" recursively.
-func dcopy(srcdir, destdir string, info os.FileInfo) error {
+func (c *copier) dcopy(srcdir, destdir string, info os.FileInfo) error {
 
-	if err := os.MkdirAll(destdir, info.Mode()); err != nil {
+	if err := os.MkdirAll(destdir, os.ModePerm); err != nil {
 		return err
 	}
 
@@ -74,20 +119,35 @@ func dcopy(srcdir, destdir string, info os.FileInfo) error {
 
 	for _, content := range contents {
 		cs, cd := filepath.Join(srcdir, content.Name()), filepath.Join(destdir, content.Name())
-		if err := copy(cs, cd, content); err != nil {
+		if err := c.copy(cs, cd, content); err != nil {
 			// If any error, exit immediately
 			return err
 		}
 	}
-	return nil
+
+	// the mode is applied after the contents are written, and MkdirAll applies the umask and leaves
+	// existing dirs alone
+	return os.Chmod(destdir, info.Mode()|0700)
 }
 
 // lcopy is for a symlink,
 // with just creating a new symlink by replicating src symlink.
-func lcopy(src, dest string, info os.FileInfo) error {
-	src, err := os.Readlink(src)
+// Absolute links into the tree being copied are made relative,
+// so they point into the copy.
+func (c *copier) lcopy(src, dest string, info os.FileInfo) error {
+	link, err := os.Readlink(src)
 	if err != nil {
 		return err
 	}
-	return os.Symlink(src, dest)
+	if filepath.IsAbs(link) && (link == c.root || strings.HasPrefix(link, c.root+string(filepath.Separator))) {
+		rel, err := filepath.Rel(filepath.Dir(src), link)
+		if err != nil {
+			return err
+		}
+		link = rel
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Symlink(link, dest)
 }
@@ -0,0 +1,62 @@
+package libgo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgo-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(fpath, 0777)
+			}
+			return nil
+		})
+		os.RemoveAll(dir)
+	}()
+
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	if err := os.MkdirAll(filepath.Join(src, "pkg"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "pkg", "a.go"), []byte("package a\n"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "pkg", "run.sh"), []byte("#!/bin/sh\n"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{filepath.Join(src, "pkg"), src} {
+		if err := os.Chmod(d, 0555); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Copy(src, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for fpath, expected := range map[string]os.FileMode{
+		dest:                                 0755,
+		filepath.Join(dest, "pkg"):           0755,
+		filepath.Join(dest, "pkg", "a.go"):   0644,
+		filepath.Join(dest, "pkg", "run.sh"): 0755,
+	} {
+		info, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != expected {
+			t.Errorf("%s: expected mode %v, got %v", fpath, expected, info.Mode().Perm())
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, "pkg", "a.go"), []byte("package b\n"), 0666); err != nil {
+		t.Errorf("expected the copy to be writable: %v", err)
+	}
+}
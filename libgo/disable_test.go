@@ -0,0 +1,155 @@
+package libgo
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/goast"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/dave/libify"
+	"golang.org/x/tools/go/packages"
+)
+
+const disableTestsSource = `package a
+
+import "testing"
+
+func TestT(t *testing.T) {
+	t.Log("t")
+}
+
+func TestUnnamed(*testing.T) {}
+
+func TestBlank(_ *testing.T) {}
+
+func BenchmarkB(b *testing.B) {
+	b.Log("b")
+}
+
+func FuzzF(f *testing.F) {
+	f.Log("f")
+}
+
+func ExampleE() {
+	// Output:
+}
+
+func TestMain(m *testing.M) {
+	m.Run()
+}
+
+func helper() {}
+`
+
+func TestDisableTests(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns map[string]string
+		loaded   bool     // the test files of the package were loaded
+		expected []string // lines expected in the output
+		missing  []string // lines that mustn't be in the output
+		warnings []string
+	}{
+		{
+			name:     "test",
+			patterns: map[string]string{"TestT": "reason"},
+			loaded:   true,
+			expected: []string{"\t// test disabled\n\tt.Skip(\"reason\")\n"},
+			missing:  []string{`t.Log("t")`},
+		},
+		{
+			name:     "unnamed params are named",
+			patterns: map[string]string{"/^Test(Unnamed|Blank)$/": ""},
+			loaded:   true,
+			expected: []string{"func TestUnnamed(t *testing.T) {", "func TestBlank(t *testing.T) {", `t.Skip("disabled by libgo")`},
+		},
+		{
+			name:     "benchmark and fuzz test",
+			patterns: map[string]string{"BenchmarkB": "b", "FuzzF": "f"},
+			loaded:   true,
+			expected: []string{`b.Skip("b")`, `f.Skip("f")`},
+			missing:  []string{`b.Log("b")`, `f.Log("f")`},
+		},
+		{
+			name:     "examples are removed",
+			patterns: map[string]string{"Example*": ""},
+			loaded:   true,
+			missing:  []string{"func ExampleE()"},
+		},
+		{
+			name:     "funcs without a testing param are left alone",
+			patterns: map[string]string{"TestMain": "", "helper": ""},
+			loaded:   true,
+			expected: []string{"\tm.Run()", "func helper() {}"},
+			warnings: []string{
+				`TestMain in root/a matches "TestMain" but has no *testing.T, *testing.B or *testing.F parameter`,
+				`helper in root/a matches "helper" but has no *testing.T, *testing.B or *testing.F parameter`,
+			},
+		},
+		{
+			name:     "pattern matches nothing",
+			patterns: map[string]string{"TestMissing": "", "TestT": ""},
+			loaded:   true,
+			warnings: []string{`disable tests pattern "TestMissing" matches nothing in root/a`},
+		},
+		{
+			name:     "no warning if the tests weren't loaded",
+			patterns: map[string]string{"TestMissing": ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := decorator.NewDecoratorWithImports(token.NewFileSet(), "root/a", goast.WithResolver(guess.New()))
+			f, err := d.ParseFile("a_test.go", disableTestsSource, parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var warnings []string
+			l := &libgoer{
+				options: Options{
+					DisableTests: map[string]map[string]string{"root/a": test.patterns},
+					Out:          ioutil.Discard,
+					Observer: func(e libify.Event) {
+						if e.Kind == libify.WarningFound {
+							warnings = append(warnings, e.Message)
+						}
+					},
+				},
+				pkgs: []*decorator.Package{{
+					Package:   &packages.Package{PkgPath: "root/a"},
+					Decorator: d,
+					Syntax:    []*dst.File{f},
+				}},
+				testsLoaded: map[string]bool{"root/a": test.loaded},
+			}
+			if err := l.disableTests(); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := &bytes.Buffer{}
+			if err := decorator.NewRestorerWithImports("root/a", guess.New()).Fprint(buf, f); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			for _, s := range test.expected {
+				if !strings.Contains(out, s) {
+					t.Errorf("expected output to contain %q, got:\n%s", s, out)
+				}
+			}
+			for _, s := range test.missing {
+				if strings.Contains(out, s) {
+					t.Errorf("expected output not to contain %q, got:\n%s", s, out)
+				}
+			}
+			if strings.Join(warnings, "\n") != strings.Join(test.warnings, "\n") {
+				t.Errorf("expected warnings:\n%s\ngot:\n%s", strings.Join(test.warnings, "\n"), strings.Join(warnings, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package libgo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/libify"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Discover runs the tests of the extracted packages in RootDir (as they were before libify, checked
+// out to a temp dir so the branch isn't changed), and the tests of the same packages in the source
+// tree. Tests that fail only after extraction (e.g. because they depend on the GOROOT layout) are
+// added to a copy of Options.DisableTests, which is returned so it can be saved to the config. Tests
+// are run with the local toolchain and GOPROXY=off, so the network isn't used. Test files are only
+// extracted when Options.Tests is set, so Discover finds nothing unless the target was extracted
+// with Tests on. Every preset leaves Tests off, so turn it on for the target first.
+func Discover(ctx context.Context, options Options) (map[string]map[string]string, error) {
+
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	if options.Out == nil {
+		options.Out = os.Stdout
+	}
+
+	l := &libgoer{
+		options: options,
+	}
+
+	l.include = compilePatterns(options.Include, DefaultInclude)
+	l.exclude = compilePatterns(options.Exclude, nil)
+
+	if err := l.checkGoroot(); err != nil {
+		return nil, err
+	}
+
+	if !l.options.Force {
+		if err := l.checkManifest(); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "libgo-discover")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := l.checkoutUnlibified(dir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return l.discover(ctx, dir)
+}
+
+// checkoutUnlibified writes the files of the commit before the last libify run (or HEAD if libify
+// hasn't been run) to dir. The branch, HEAD and the files in RootDir aren't changed.
+func (l *libgoer) checkoutUnlibified(dir string) error {
+	defer l.progress().Phase("checkout")()
+
+	r, err := git.PlainOpen(l.options.RootDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	h, err := r.Head()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c, err := r.CommitObject(h.Hash())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	last, err := lastPhaseCommit(r, h.Hash(), phaseLibify)
+	if err != nil {
+		return err
+	}
+	if last != nil && last.NumParents() > 0 {
+		if c, err = last.Parent(0); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return tree.Files().ForEach(func(f *object.File) error {
+		fpath := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0777); err != nil {
+			return errors.WithStack(err)
+		}
+		contents, err := f.Contents()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		switch f.Mode {
+		case filemode.Symlink:
+			err = os.Symlink(contents, fpath)
+		case filemode.Executable:
+			err = ioutil.WriteFile(fpath, []byte(contents), 0777)
+		default:
+			err = ioutil.WriteFile(fpath, []byte(contents), 0666)
+		}
+		return errors.WithStack(err)
+	})
+}
+
+// discover runs the tests in dir, which has the extracted packages before libify
+func (l *libgoer) discover(ctx context.Context, dir string) (map[string]map[string]string, error) {
+	defer l.progress().Phase("discover")()
+
+	// the extracted tests are run first, so only the packages with failures need to be run in the
+	// source tree.
+	extracted, err := l.runTests(ctx, dir, "./...")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	failed := map[string]map[string]bool{} // source package path (without _test) -> test name
+	for p, tests := range extracted {
+		if !strings.HasPrefix(p, l.options.RootPath+"/") {
+			continue
+		}
+		failed[strings.TrimPrefix(p, l.options.RootPath+"/")] = tests
+	}
+	if len(failed) == 0 {
+		return l.options.DisableTests, nil
+	}
+
+	var paths []string
+	for p := range failed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	original, err := l.runTests(ctx, filepath.Join(l.goroot(), "src"), paths...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	disable := map[string]map[string]string{}
+	for p, tests := range l.options.DisableTests {
+		disable[p] = map[string]string{}
+		for name, v := range tests {
+			disable[p][name] = v
+		}
+	}
+	for _, p := range paths {
+		external, err := l.externalTests(p)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for name := range failed[p] {
+			if original[p][name] {
+				l.progress().Send(libify.Event{
+					Kind:    libify.WarningFound,
+					Package: p,
+					Message: fmt.Sprintf("%s in %s also fails in the source tree - not disabled", name, p),
+				})
+				continue
+			}
+			key := p
+			if external[name] {
+				key = p + "_test"
+			}
+			if disable[key] == nil {
+				disable[key] = map[string]string{}
+			}
+			disable[key][name] = "fails after extraction (found by libgo discover)"
+		}
+	}
+	return disable, nil
+}
+
+// testEvent is a line of the output of go test -json
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+}
+
+// runTests runs go test -json in dir, and returns the failed top level tests by package path.
+// Packages that fail without a failed test (e.g. because they don't build) are reported as
+// warnings.
+func (l *libgoer) runTests(ctx context.Context, dir string, args ...string) (map[string]map[string]bool, error) {
+	defer l.progress().Phase("runTests " + dir)()
+
+	cmd := exec.CommandContext(ctx, l.goCmd, append([]string{"test", "-json"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(l.env(), "GOPROXY=off")
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok || stdout.Len() == 0 {
+			// go test exits with an error when tests fail, so it's only a problem if nothing was run
+			return nil, errors.Errorf("go test in %s: %v: %s", dir, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	failed := map[string]map[string]bool{}
+	failedPackages := map[string]bool{}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var e testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// build errors are interleaved as plain text
+			continue
+		}
+		if e.Action != "fail" {
+			continue
+		}
+		if e.Test == "" {
+			failedPackages[e.Package] = true
+			continue
+		}
+		// subtests fail with their parent, so only the top level test is disabled
+		if i := strings.Index(e.Test, "/"); i > -1 {
+			e.Test = e.Test[:i]
+		}
+		if failed[e.Package] == nil {
+			failed[e.Package] = map[string]bool{}
+		}
+		failed[e.Package][e.Test] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for p := range failedPackages {
+		if failed[p] == nil {
+			l.progress().Send(libify.Event{
+				Kind:    libify.WarningFound,
+				Package: p,
+				Message: fmt.Sprintf("%s failed without a failed test (does it build?)", p),
+			})
+		}
+	}
+	return failed, nil
+}
+
+// externalTests returns the names of the test funcs declared in the external (_test) package of p
+// in the source tree.
+func (l *libgoer) externalTests(p string) (map[string]bool, error) {
+	dir := filepath.Join(l.goroot(), "src", filepath.FromSlash(p))
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	external := map[string]bool{}
+	fset := token.NewFileSet()
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, fi.Name()), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !strings.HasSuffix(f.Name.Name, "_test") {
+			continue
+		}
+		for _, decl := range f.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+				external[fd.Name.Name] = true
+			}
+		}
+	}
+	return external, nil
+}
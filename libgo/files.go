@@ -0,0 +1,319 @@
+package libgo
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// copyPackageFiles copies the files in the dir of package p that weren't written from Syntax:
+// files excluded by build constraints (for other platforms, or "ignore" generators), assembly,
+// headers, testdata etc. If convert is set, Go files have their imports rewritten. Test files are
+// only copied if the tests of the package were loaded, because the packages they import may not
+// have been extracted otherwise. Toolchain build time generated files missing from the source tree
+// are generated.
+func (l *libgoer) copyPackageFiles(p string, written map[string]bool, convert bool) error {
+	oldDir := filepath.Join(l.goroot(), "src", filepath.FromSlash(p))
+	newDir := l.convertDir(p)
+
+	if err := os.MkdirAll(newDir, 0777); err != nil {
+		return errors.WithStack(err)
+	}
+	if fi, err := os.Stat(filepath.Join(oldDir, "testdata")); err == nil && fi.IsDir() {
+		if err := Copy(filepath.Join(oldDir, "testdata"), filepath.Join(newDir, "testdata")); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := l.copyEmbeds(p, oldDir, newDir); err != nil {
+		return errors.WithStack(err)
+	}
+
+	fis, err := ioutil.ReadDir(oldDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		oldPath := filepath.Join(oldDir, fi.Name())
+		newPath := filepath.Join(newDir, fi.Name())
+		if written[newPath] {
+			continue
+		}
+		if strings.HasSuffix(fi.Name(), "_test.go") && !l.testsLoaded[p] {
+			continue
+		}
+		if !convert || (!strings.HasSuffix(fi.Name(), ".go") && !strings.HasSuffix(fi.Name(), ".s")) {
+			if err := Copy(oldPath, newPath); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+		src, err := ioutil.ReadFile(oldPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var out []byte
+		if strings.HasSuffix(fi.Name(), ".s") {
+			out = l.rewriteAsm(p, oldPath, src)
+		} else {
+			out, err = l.rewriteImports(oldPath, src)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			out = l.rewriteLinknames(out)
+		}
+		if err := ioutil.WriteFile(newPath, out, fi.Mode().Perm()); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, g := range generatedFiles {
+		if g.pkg != p {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(oldDir, g.file)); err == nil {
+			// the source tree has been built, so the file already exists and was copied
+			continue
+		}
+		src, err := g.gen(l)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(newDir, g.file), []byte(src), 0666); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// embeds are the go:embed patterns of a package, and the files they match
+type embeds struct {
+	patterns []string
+	files    []string // absolute paths
+}
+
+// copyEmbeds copies the files embedded by package p. Dirs matched by a pattern are copied whole,
+// leaving out the files that go:embed leaves out (names starting with "." or "_") unless the
+// pattern has the "all:" prefix. Other embedded files (which may be in sub dirs) are copied
+// individually. Embedded files in the package dir itself are copied with the other files.
+func (l *libgoer) copyEmbeds(p, oldDir, newDir string) error {
+	e := l.embeds[p]
+	if e == nil {
+		return nil
+	}
+	for _, pattern := range e.patterns {
+		var exclude []string
+		if strings.HasPrefix(pattern, "all:") {
+			pattern = strings.TrimPrefix(pattern, "all:")
+		} else {
+			exclude = []string{".*", "_*"}
+		}
+		matches, err := filepath.Glob(filepath.Join(oldDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, match := range matches {
+			if fi, err := os.Stat(match); err != nil || !fi.IsDir() {
+				continue
+			}
+			rel, err := filepath.Rel(oldDir, match)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := Copy(match, filepath.Join(newDir, rel), exclude...); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	for _, fpath := range e.files {
+		rel, err := filepath.Rel(oldDir, fpath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if filepath.Dir(rel) == "." {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(newDir, rel)); err == nil {
+			continue
+		}
+		if err := Copy(fpath, filepath.Join(newDir, rel)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// rewriteImports converts the import paths in a Go source file, and the string literals that refer
+// to symbols in extracted packages (see convertString). Only the literals are changed - the rest of
+// the file is left byte for byte the same, and build constraints are ignored.
+func (l *libgoer) rewriteImports(fpath string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, fpath, src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	imports := map[*ast.BasicLit]bool{}
+	for _, imp := range f.Imports {
+		imports[imp.Path] = true
+		p, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", fset.Position(imp.Path.Pos()))
+		}
+		newPath := l.convertPath(p)
+		if newPath == p {
+			continue
+		}
+		edits = append(edits, edit{
+			start: fset.Position(imp.Path.Pos()).Offset,
+			end:   fset.Position(imp.Path.End()).Offset,
+			text:  strconv.Quote(newPath),
+		})
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING || imports[lit] {
+			return true
+		}
+		s, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return true
+		}
+		if converted := l.convertString(s); converted != s {
+			edits = append(edits, edit{
+				start: fset.Position(lit.Pos()).Offset,
+				end:   fset.Position(lit.End()).Offset,
+				text:  strconv.Quote(converted),
+			})
+		}
+		return true
+	})
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	out := append([]byte(nil), src...)
+	for _, e := range edits {
+		out = append(out[:e.start], append([]byte(e.text), out[e.end:]...)...)
+	}
+	return out, nil
+}
+
+// generatedFiles are written by "go tool dist" when the toolchain is built, so they're missing
+// from source trees that haven't been built. internal/buildcfg is generated by the tree's own
+// cmd/dist, and stubs with the dist defaults are generated for the others.
+var generatedFiles = []struct {
+	pkg, file string
+	gen       func(l *libgoer) (string, error)
+}{
+	{"internal/buildcfg", "zbootstrap.go", genBuildcfg},
+	{"cmd/internal/objabi", "zbootstrap.go", genObjabi},
+	{"cmd/go/internal/cfg", "zdefaultcc.go", func(l *libgoer) (string, error) {
+		return genDefaultCC("cfg", "DefaultPkgConfig", "DefaultCC", "DefaultCXX"), nil
+	}},
+	{"cmd/cgo", "zdefaultcc.go", func(l *libgoer) (string, error) {
+		return genDefaultCC("main", "defaultPkgConfig", "defaultCC", "defaultCXX"), nil
+	}},
+}
+
+const generatedHeader = "// Code generated by libgo (stub for go tool dist); DO NOT EDIT.\n\n"
+
+// genBuildcfg generates internal/buildcfg/zbootstrap.go the way make.bash does: the cmd/dist of
+// the source tree is built with an extra command that calls its mkbuildcfg, and run with GOROOT set
+// to the source tree. The defaults (GOAMD64, GOEXPERIMENT etc.) and the constants themselves change
+// between releases, so they're taken from the tree rather than hard-coded. As with make.bash,
+// GOAMD64 etc. in the environment override the defaults.
+func genBuildcfg(l *libgoer) (string, error) {
+	dir, err := ioutil.TempDir("", "libgo-dist")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	distDir := filepath.Join(l.goroot(), "src", "cmd", "dist")
+	fis, err := ioutil.ReadDir(distDir)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), "_test.go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(distDir, fi.Name()))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fi.Name()), b, 0666); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	extra := map[string]string{
+		"go.mod":            fmt.Sprintf("module dist\n\ngo %s\n", strings.TrimPrefix(majorMinor(l.goVersion), "go")),
+		"libgo_buildcfg.go": "package main\n\nimport \"os\"\n\nfunc init() {\n\tcommands[\"libgo-buildcfg\"] = func() { mkbuildcfg(os.Args[1]) }\n}\n",
+	}
+	for name, src := range extra {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	// dist is built by the go command with its own GOROOT, because the source tree hasn't been built
+	dist := filepath.Join(dir, "dist")
+	if runtime.GOOS == "windows" {
+		dist += ".exe"
+	}
+	build := exec.Command(l.goCmd, "build", "-o", dist, ".")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=")
+	if out, err := build.CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "building cmd/dist of %s: %s", l.goroot(), out)
+	}
+
+	file := filepath.Join(dir, "zbootstrap.go")
+	run := exec.Command(dist, "libgo-buildcfg", file)
+	run.Env = append(os.Environ(), "GOROOT="+l.goroot())
+	if out, err := run.CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "running cmd/dist of %s: %s", l.goroot(), out)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(b), nil
+}
+
+func genObjabi(l *libgoer) (string, error) {
+	return generatedHeader + "package objabi\n", nil
+}
+
+func genDefaultCC(pkg, pkgConfig, cc, cxx string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(generatedHeader)
+	fmt.Fprintf(buf, "package %s\n\n", pkg)
+	fmt.Fprintf(buf, "const %s = `pkg-config`\n\n", pkgConfig)
+	for _, f := range []struct{ name, clang, gcc string }{{cc, "clang", "gcc"}, {cxx, "clang++", "g++"}} {
+		fmt.Fprintf(buf, "func %s(goos, goarch string) string {\n", f.name)
+		fmt.Fprint(buf, "\tswitch goos {\n")
+		fmt.Fprint(buf, "\tcase \"darwin\", \"ios\", \"freebsd\", \"openbsd\":\n")
+		fmt.Fprintf(buf, "\t\treturn %q\n", f.clang)
+		fmt.Fprint(buf, "\t}\n")
+		fmt.Fprintf(buf, "\treturn %q\n", f.gcc)
+		fmt.Fprint(buf, "}\n\n")
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,83 @@
+package libgo
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultInclude is used if Options.Include is empty. GOROOT packages that can't be imported from
+// outside GOROOT are extracted, along with the vendored golang.org/x packages they use.
+var DefaultInclude = []string{"cmd/...", "internal/...", "vendor/golang.org/x/..."}
+
+// filter returns true if the package with path p should be extracted: it must match one of the
+// include patterns and none of the exclude patterns.
+func (l *libgoer) filter(p string) bool {
+	return matchAny(l.include, p) && !matchAny(l.exclude, p)
+}
+
+func matchAny(patterns []*regexp.Regexp, p string) bool {
+	for _, re := range patterns {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePatterns compiles package path patterns, which use the same syntax as the go command:
+// "..." matches any string, and a trailing "/..." also matches the path without it (so
+// "cmd/..." matches "cmd" and "cmd/compile"). If patterns is empty, defaults is used.
+func compilePatterns(patterns, defaults []string) []*regexp.Regexp {
+	if len(patterns) == 0 {
+		patterns = defaults
+	}
+	var out []*regexp.Regexp
+	for _, pattern := range patterns {
+		re := regexp.QuoteMeta(pattern)
+		re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+		if strings.HasSuffix(re, `/.*`) {
+			re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+		}
+		out = append(out, regexp.MustCompile("^"+re+"$"))
+	}
+	return out
+}
+
+// isVendored returns true if p is a package in GOROOT/src/vendor
+func isVendored(p string) bool {
+	return strings.HasPrefix(p, "vendor/")
+}
+
+// matchTest returns the pattern that matches the test func name, and its reason. Patterns are
+// globs (e.g. "TestDWARF*"), or regular expressions between slashes (e.g. "/^Test(Foo|Bar)$/").
+// If several patterns match, the first in sorted order is used so the result is deterministic.
+func matchTest(patterns map[string]string, name string) (pattern, reason string, err error) {
+	var sorted []string
+	for p := range patterns {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+	for _, p := range sorted {
+		var match bool
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile(p[1 : len(p)-1])
+			if err != nil {
+				return "", "", errors.Wrapf(err, "test pattern %q", p)
+			}
+			match = re.MatchString(name)
+		} else {
+			match, err = path.Match(p, name)
+			if err != nil {
+				return "", "", errors.Wrapf(err, "test pattern %q", p)
+			}
+		}
+		if match {
+			return p, patterns[p], nil
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,150 @@
+package libgo
+
+import (
+	"testing"
+)
+
+func TestCompilePatterns(t *testing.T) {
+	tests := []struct {
+		patterns, defaults []string
+		path               string
+		expected           bool
+	}{
+		{patterns: []string{"cmd/..."}, path: "cmd", expected: true},
+		{patterns: []string{"cmd/..."}, path: "cmd/compile", expected: true},
+		{patterns: []string{"cmd/..."}, path: "cmd/compile/internal/ssa", expected: true},
+		{patterns: []string{"cmd/..."}, path: "cmdx", expected: false},
+		{patterns: []string{"cmd/..."}, path: "internal/cmd", expected: false},
+		{patterns: []string{"cmd/go"}, path: "cmd/go", expected: true},
+		{patterns: []string{"cmd/go"}, path: "cmd/go/internal/load", expected: false},
+		{patterns: []string{"cmd/go"}, path: "x/cmd/go", expected: false},
+		{patterns: []string{"internal/.../testenv"}, path: "internal/testenv", expected: false},
+		{patterns: []string{"internal/.../testenv"}, path: "internal/a/testenv", expected: true},
+		{patterns: []string{"cmd/...obj"}, path: "cmd/internal/obj", expected: true},
+		{patterns: []string{"vendor/golang.org/x/..."}, path: "vendor/golangXorg/x/arch", expected: false},
+		{patterns: []string{"a+b"}, path: "a+b", expected: true},
+		{patterns: []string{"a+b"}, path: "aab", expected: false},
+		{patterns: []string{"cmd/compile", "cmd/link"}, path: "cmd/link", expected: true},
+		{defaults: DefaultInclude, path: "internal/abi", expected: true},
+		{defaults: DefaultInclude, path: "vendor/golang.org/x/arch/x86/x86asm", expected: true},
+		{defaults: DefaultInclude, path: "fmt", expected: false},
+		{patterns: []string{"cmd/go"}, defaults: DefaultInclude, path: "internal/abi", expected: false},
+		{path: "cmd", expected: false},
+	}
+	for _, test := range tests {
+		if found := matchAny(compilePatterns(test.patterns, test.defaults), test.path); found != test.expected {
+			t.Errorf("%q (defaults %q) matching %q: expected %v, found %v", test.patterns, test.defaults, test.path, test.expected, found)
+		}
+	}
+}
+
+func TestMatchTest(t *testing.T) {
+	tests := []struct {
+		name            string
+		patterns        map[string]string
+		test            string
+		pattern, reason string
+		err             string
+	}{
+		{
+			name:     "exact",
+			patterns: map[string]string{"TestFoo": "a"},
+			test:     "TestFoo",
+			pattern:  "TestFoo",
+			reason:   "a",
+		},
+		{
+			name:     "glob is anchored",
+			patterns: map[string]string{"TestFoo": "a"},
+			test:     "TestFooBar",
+		},
+		{
+			name:     "glob star",
+			patterns: map[string]string{"TestDWARF*": "a"},
+			test:     "TestDWARFiOS",
+			pattern:  "TestDWARF*",
+			reason:   "a",
+		},
+		{
+			name:     "glob class",
+			patterns: map[string]string{"Benchmark[AB]": "a"},
+			test:     "BenchmarkB",
+			pattern:  "Benchmark[AB]",
+			reason:   "a",
+		},
+		{
+			name:     "regexp isn't anchored",
+			patterns: map[string]string{"/Foo/": "a"},
+			test:     "TestFooBar",
+			pattern:  "/Foo/",
+			reason:   "a",
+		},
+		{
+			name:     "anchored regexp",
+			patterns: map[string]string{"/^Test(Foo|Bar)$/": "a"},
+			test:     "TestFooBar",
+		},
+		{
+			name:     "anchored regexp matches",
+			patterns: map[string]string{"/^Test(Foo|Bar)$/": "a"},
+			test:     "TestBar",
+			pattern:  "/^Test(Foo|Bar)$/",
+			reason:   "a",
+		},
+		{
+			name:     "single slash is a glob",
+			patterns: map[string]string{"/": "a"},
+			test:     "/",
+			pattern:  "/",
+			reason:   "a",
+		},
+		{
+			name:     "first sorted pattern wins",
+			patterns: map[string]string{"TestF*": "b", "/^TestFoo$/": "a", "TestFoo": "c"},
+			test:     "TestFoo",
+			pattern:  "/^TestFoo$/",
+			reason:   "a",
+		},
+		{
+			name:     "helpers can match",
+			patterns: map[string]string{"*Helper": "a"},
+			test:     "setupHelper",
+			pattern:  "*Helper",
+			reason:   "a",
+		},
+		{
+			name:     "no patterns",
+			patterns: nil,
+			test:     "TestFoo",
+		},
+		{
+			name:     "bad glob",
+			patterns: map[string]string{"Test[": "a"},
+			test:     "TestFoo",
+			err:      `test pattern "Test[": syntax error in pattern`,
+		},
+		{
+			name:     "bad regexp",
+			patterns: map[string]string{"/Test(/": "a"},
+			test:     "TestFoo",
+			err:      "test pattern \"/Test(/\": error parsing regexp: missing closing ): `Test(`",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pattern, reason, err := matchTest(test.patterns, test.test)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pattern != test.pattern || reason != test.reason {
+				t.Errorf("expected %q, %q, got %q, %q", test.pattern, test.reason, pattern, reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package libgo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/libify"
+	"github.com/pkg/errors"
+)
+
+// writeGoMod writes go.mod to the root dir. The go directive and require lines are copied from
+// GOROOT/src/cmd/go.mod, and GOROOT/src/cmd/vendor is copied to the root dir (modules.txt lists
+// the same requirements), so the extracted module builds offline in vendor mode. Source trees that
+// predate cmd/go.mod get a go.mod with just the module path and the source Go version. The modules
+// of any extracted GOROOT/src/vendor packages are added to go.mod and modules.txt.
+func (l *libgoer) writeGoMod() error {
+	defer l.progress().Phase("writeGoMod")()
+
+	cmdDir := filepath.Join(l.goroot(), "src", "cmd")
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "module %s\n", l.options.RootPath)
+
+	b, err := ioutil.ReadFile(filepath.Join(cmdDir, "go.mod"))
+	switch {
+	case os.IsNotExist(err):
+		fmt.Fprintf(buf, "\ngo %s\n", strings.TrimPrefix(majorMinor(l.goVersion), "go"))
+	case err != nil:
+		return errors.WithStack(err)
+	default:
+		// everything apart from the module directive is copied
+		for _, line := range strings.SplitAfter(string(b), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "module ") {
+				continue
+			}
+			buf.WriteString(line)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(cmdDir, "go.sum")); err == nil {
+		if err := Copy(filepath.Join(cmdDir, "go.sum"), filepath.Join(l.options.RootDir, "go.sum")); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(cmdDir, "vendor")); err == nil && fi.IsDir() {
+		if err := Copy(filepath.Join(cmdDir, "vendor"), filepath.Join(l.options.RootDir, "vendor")); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := l.addVendoredModules(buf); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(l.options.RootDir, "go.mod"), buf.Bytes(), 0666); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// addVendoredModules adds the modules of the extracted GOROOT/src/vendor packages (which copyFiles
+// has already written to the vendor dir) to modules.txt, and adds require lines to gomod for
+// modules that GOROOT/src/cmd doesn't already require.
+func (l *libgoer) addVendoredModules(gomod *bytes.Buffer) error {
+	if len(l.vendored) == 0 {
+		return nil
+	}
+	srcDir := filepath.Join(l.goroot(), "src")
+	std, err := readModulesTxt(filepath.Join(srcDir, "vendor", "modules.txt"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stdRequires, err := readRequires(filepath.Join(srcDir, "go.mod"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fpath := filepath.Join(l.options.RootDir, "vendor", "modules.txt")
+	mods, err := readModulesTxt(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	var requires []string
+	for _, p := range l.vendored {
+		stdMod := findVendorModule(std, p)
+		if stdMod == nil {
+			return errors.Errorf("can't find the module of vendored package %s in GOROOT/src/vendor/modules.txt", p)
+		}
+		mod := findModule(mods, stdMod.path)
+		if mod == nil {
+			mod = &vendorModule{path: stdMod.path, version: stdMod.version, header: stdMod.header, meta: stdMod.meta}
+			mods = append(mods, mod)
+			if line, ok := stdRequires[stdMod.path]; ok {
+				requires = append(requires, line)
+			}
+		} else if mod.version != stdMod.version {
+			l.progress().Send(libify.Event{
+				Kind:    libify.WarningFound,
+				Message: fmt.Sprintf("vendored package %s is from %s %s in GOROOT/src but %s in GOROOT/src/cmd - using %s", p, mod.path, stdMod.version, mod.version, mod.version),
+			})
+		}
+		mod.addPackage(p)
+	}
+
+	if len(requires) > 0 {
+		sort.Strings(requires)
+		fmt.Fprintf(gomod, "\nrequire (\n")
+		for _, line := range requires {
+			fmt.Fprintf(gomod, "\t%s\n", line)
+		}
+		fmt.Fprintf(gomod, ")\n")
+	}
+
+	sort.Slice(mods, func(i, j int) bool { return mods[i].path < mods[j].path })
+	return writeModulesTxt(fpath, mods)
+}
+
+// vendorModule is a module in vendor/modules.txt
+type vendorModule struct {
+	path, version string
+	header        string   // e.g. "# golang.org/x/net v0.1.0"
+	meta          []string // e.g. "## explicit; go 1.18"
+	packages      []string
+}
+
+func (m *vendorModule) addPackage(p string) {
+	for _, existing := range m.packages {
+		if existing == p {
+			return
+		}
+	}
+	m.packages = append(m.packages, p)
+	sort.Strings(m.packages)
+}
+
+func findModule(mods []*vendorModule, path string) *vendorModule {
+	for _, m := range mods {
+		if m.path == path {
+			return m
+		}
+	}
+	return nil
+}
+
+// findVendorModule finds the module that contains package p
+func findVendorModule(mods []*vendorModule, p string) *vendorModule {
+	for _, m := range mods {
+		for _, mp := range m.packages {
+			if mp == p {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// readModulesTxt reads the modules in a vendor/modules.txt file, in file order
+func readModulesTxt(fpath string) ([]*vendorModule, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	var mods []*vendorModule
+	var current *vendorModule
+	for _, line := range strings.Split(string(b), "\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "## "):
+			if current != nil {
+				current.meta = append(current.meta, line)
+			}
+		case strings.HasPrefix(line, "# "):
+			fields := strings.Fields(line)
+			current = &vendorModule{header: line, path: fields[1]}
+			// replacements of modules that aren't required have no version (e.g. "# m => ./m")
+			if len(fields) > 2 && fields[2] != "=>" {
+				current.version = fields[2]
+			}
+			mods = append(mods, current)
+		default:
+			if current != nil {
+				current.packages = append(current.packages, line)
+			}
+		}
+	}
+	return mods, nil
+}
+
+func writeModulesTxt(fpath string, mods []*vendorModule) error {
+	buf := &bytes.Buffer{}
+	for _, m := range mods {
+		fmt.Fprintln(buf, m.header)
+		for _, line := range m.meta {
+			fmt.Fprintln(buf, line)
+		}
+		for _, p := range m.packages {
+			fmt.Fprintln(buf, p)
+		}
+	}
+	if err := ioutil.WriteFile(fpath, buf.Bytes(), 0666); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// readRequires returns the require lines in a go.mod file (e.g. "golang.org/x/net v0.1.0 //
+// indirect"), keyed by module path.
+func readRequires(fpath string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	requires := map[string]string{}
+	var block bool
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "require (":
+			block = true
+			continue
+		case block && line == ")":
+			block = false
+			continue
+		case strings.HasPrefix(line, "require "):
+			line = strings.TrimSpace(strings.TrimPrefix(line, "require "))
+		case !block:
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			requires[fields[0]] = line
+		}
+	}
+	return requires, nil
+}
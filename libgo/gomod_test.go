@@ -0,0 +1,108 @@
+package libgo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadModulesTxt(t *testing.T) {
+	mods, err := readModulesTxt(filepath.Join("testdata", "src", "vendor", "modules.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*vendorModule{
+		{
+			path:     "golang.org/x/crypto",
+			version:  "v0.16.1-0.20231129163542-152cdb1503eb",
+			header:   "# golang.org/x/crypto v0.16.1-0.20231129163542-152cdb1503eb",
+			meta:     []string{"## explicit; go 1.18"},
+			packages: []string{"golang.org/x/crypto/chacha20", "golang.org/x/crypto/chacha20poly1305"},
+		},
+		{
+			path:     "golang.org/x/net",
+			version:  "v0.19.0",
+			header:   "# golang.org/x/net v0.19.0 => ./net",
+			meta:     []string{"## explicit; go 1.18"},
+			packages: []string{"golang.org/x/net/dns/dnsmessage", "golang.org/x/net/http/httpguts"},
+		},
+		{
+			path:     "golang.org/x/sys",
+			version:  "v0.15.0",
+			header:   "# golang.org/x/sys v0.15.0",
+			meta:     []string{"## explicit; go 1.18"},
+			packages: []string{"golang.org/x/sys/cpu"},
+		},
+		{
+			path:     "golang.org/x/text",
+			version:  "v0.14.0",
+			header:   "# golang.org/x/text v0.14.0",
+			packages: []string{"golang.org/x/text/unicode/norm"},
+		},
+		{
+			path:   "golang.org/x/tools",
+			header: "# golang.org/x/tools => ./tools",
+		},
+	}
+	if len(mods) != len(expected) {
+		t.Fatalf("expected %d modules, got %d", len(expected), len(mods))
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(mods[i], expected[i]) {
+			t.Errorf("module %d: expected %+v, got %+v", i, *expected[i], *mods[i])
+		}
+	}
+
+	if m := findVendorModule(mods, "golang.org/x/net/http/httpguts"); m == nil || m.path != "golang.org/x/net" {
+		t.Errorf("expected golang.org/x/net to contain golang.org/x/net/http/httpguts, got %+v", m)
+	}
+	if m := findVendorModule(mods, "golang.org/x/net"); m != nil {
+		t.Errorf("expected no module to contain golang.org/x/net, got %+v", m)
+	}
+}
+
+func TestWriteModulesTxt(t *testing.T) {
+	fpath := filepath.Join("testdata", "src", "vendor", "modules.txt")
+	mods, err := readModulesTxt(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "modules.txt")
+	if err := writeModulesTxt(out, mods); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(found) != string(expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, found)
+	}
+}
+
+func TestReadRequires(t *testing.T) {
+	requires, err := readRequires(filepath.Join("testdata", "src", "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"golang.org/x/crypto": "golang.org/x/crypto v0.16.1-0.20231129163542-152cdb1503eb",
+		"golang.org/x/net":    "golang.org/x/net v0.19.0",
+		"golang.org/x/sys":    "golang.org/x/sys v0.15.0 // indirect",
+		"golang.org/x/text":   "golang.org/x/text v0.14.0 // indirect",
+	}
+	if !reflect.DeepEqual(requires, expected) {
+		t.Errorf("expected %q, got %q", expected, requires)
+	}
+}
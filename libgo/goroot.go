@@ -0,0 +1,103 @@
+package libgo
+
+import (
+	"bytes"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// goroot returns the GOROOT to extract from
+func (l *libgoer) goroot() string {
+	if l.options.Goroot != "" {
+		return l.options.Goroot
+	}
+	return build.Default.GOROOT
+}
+
+// checkGoroot finds the Go version of the source tree and the go command to load it with, and
+// returns an error if they don't match. The tree's own bin/go is used if it has been built,
+// otherwise the go command in PATH.
+func (l *libgoer) checkGoroot() error {
+	goroot := l.goroot()
+	if fi, err := os.Stat(filepath.Join(goroot, "src", "cmd")); err != nil || !fi.IsDir() {
+		return errors.Errorf("%s is not a GOROOT: can't find src/cmd", goroot)
+	}
+
+	version, err := sourceGoVersion(goroot)
+	if err != nil {
+		return err
+	}
+
+	goCmd := filepath.Join(goroot, "bin", "go")
+	if _, err := os.Stat(goCmd); err != nil {
+		if goCmd, err = exec.LookPath("go"); err != nil {
+			return errors.Errorf("%s has no bin/go and there's no go command in PATH", goroot)
+		}
+	}
+	cmd := exec.Command(goCmd, "env", "GOVERSION")
+	cmd.Env = append(os.Environ(), "GOROOT="+goroot)
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.Wrapf(err, "running %s env GOVERSION", goCmd)
+	}
+	toolchain := strings.TrimSpace(string(out))
+
+	if majorMinor(version) != majorMinor(toolchain) {
+		return errors.Errorf("%s is %s but %s is %s: build the tree with src/make.bash, or use a go command with the same version", goroot, version, goCmd, toolchain)
+	}
+
+	l.goVersion = version
+	l.goCmd = goCmd
+	return nil
+}
+
+// env returns the environment for loading packages from the source tree
+func (l *libgoer) env() []string {
+	return append(os.Environ(),
+		"GOROOT="+l.goroot(),
+		"PATH="+filepath.Dir(l.goCmd)+string(os.PathListSeparator)+os.Getenv("PATH"),
+	)
+}
+
+var goversionConst = regexp.MustCompile(`const Version = (\d+)`)
+
+// sourceGoVersion returns the Go version of the source tree in goroot - e.g. "go1.21.3". Release
+// trees have a VERSION file. Development trees don't, so "go1.N" is returned, where N is from
+// src/internal/goversion.
+func sourceGoVersion(goroot string) (string, error) {
+	if b, err := ioutil.ReadFile(filepath.Join(goroot, "VERSION")); err == nil {
+		// the first line is the version, and may be followed by other lines (e.g. "time ...")
+		return strings.TrimSpace(string(bytes.SplitN(b, []byte("\n"), 2)[0])), nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(goroot, "src", "internal", "goversion", "goversion.go"))
+	if err != nil {
+		return "", errors.Errorf("can't find the Go version of %s: no VERSION file or src/internal/goversion", goroot)
+	}
+	matches := goversionConst.FindSubmatch(b)
+	if matches == nil {
+		return "", errors.Errorf("can't find the Go version of %s: no Version constant in src/internal/goversion", goroot)
+	}
+	return "go1." + string(matches[1]), nil
+}
+
+// majorMinor returns the language version of a Go version - e.g. "go1.21" for "go1.21.3" or
+// "go1.21rc2". Development versions like "devel go1.22-abc123 ..." are handled.
+func majorMinor(version string) string {
+	version = strings.TrimPrefix(version, "devel ")
+	if !strings.HasPrefix(version, "go1.") {
+		return version
+	}
+	rest := version[len("go1."):]
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end != -1 {
+		rest = rest[:end]
+	}
+	return "go1." + rest
+}
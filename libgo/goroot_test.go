@@ -0,0 +1,26 @@
+package libgo
+
+import (
+	"testing"
+)
+
+func TestMajorMinor(t *testing.T) {
+	tests := []struct {
+		version, expected string
+	}{
+		{"go1.21.3", "go1.21"},
+		{"go1.21", "go1.21"},
+		{"go1.21rc2", "go1.21"},
+		{"go1.22beta1", "go1.22"},
+		{"go1.9", "go1.9"},
+		{"devel go1.22-abc123 Mon Jan 1 00:00:00 2024 +0000", "go1.22"},
+		{"devel +abc123", "+abc123"},
+		{"go2.0", "go2.0"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if found := majorMinor(test.version); found != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.version, test.expected, found)
+		}
+	}
+}
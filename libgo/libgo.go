@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"go/build"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,27 +23,79 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/tools/go/packages"
 	"gopkg.in/src-d/go-git.v4"
-	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
-// Main converts a Go internal command line app to a library
-func Main(ctx context.Context, options Options) error {
+// Main converts a Go internal command line app to a library. If an upgrade fails before merging,
+// the original branch is checked out again and the pristine branch is left where it was.
+func Main(ctx context.Context, options Options) (err error) {
+
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	if options.Out == nil {
+		options.Out = os.Stdout
+	}
 
 	l := &libgoer{
 		options: options,
 	}
 
-	if options.Init {
+	l.include = compilePatterns(options.Include, DefaultInclude)
+	l.exclude = compilePatterns(options.Exclude, nil)
 
-		if err := l.prepDir(); err != nil {
-			return errors.WithStack(err)
+	if err := l.checkGoroot(); err != nil {
+		return err
+	}
+
+	if options.Init && options.Upgrade {
+		return errors.New("init and upgrade can't both be set")
+	}
+
+	if options.Init || options.Upgrade {
+
+		if options.Init {
+			if err := l.prepDir(); err != nil {
+				return errors.WithStack(err)
+			}
+		} else {
+			defer func() {
+				if err == nil {
+					return
+				}
+				if abortErr := l.abortUpgrade(); abortErr != nil {
+					err = errors.Wrapf(err, "restoring %s after the upgrade failed: %v", l.branch, abortErr)
+				}
+			}()
+			if err := l.startUpgrade(); err != nil {
+				return err
+			}
 		}
 
 		if err := l.load(ctx); err != nil {
 			return errors.WithStack(err)
 		}
 
-		if err := l.updateImportsAndDisableTests(); err != nil {
+		// each phase is committed separately, so the changes made by each can be reviewed (and
+		// diffed between Go versions) separately.
+
+		if err := l.copyFiles(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := l.writeGoMod(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := l.commit(phaseCopy); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := l.updateImports(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := l.checkLinknames(); err != nil {
 			return errors.WithStack(err)
 		}
 
@@ -47,7 +103,19 @@ func Main(ctx context.Context, options Options) error {
 			return errors.WithStack(err)
 		}
 
-		if err := l.commit(); err != nil {
+		if err := l.commit(phaseImports); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := l.disableTests(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := l.save(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := l.commit(phaseDisableTests); err != nil {
 			return errors.WithStack(err)
 		}
 
@@ -64,22 +132,71 @@ func Main(ctx context.Context, options Options) error {
 	// So the new path to the command will be github.com/foo/bar/cmd/link
 	pathCmd := path.Join(options.RootPath, options.From)
 
-	if err := libify.Main(ctx, libify.Options{RootPath: options.RootPath, Path: pathCmd}); err != nil {
+	libifyOptions := libify.Options{
+		RootPath:  options.RootPath,
+		RootDir:   options.RootDir,
+		Path:      pathCmd,
+		Tests:     options.Tests,
+		Out:       options.Out,
+		Verbosity: options.Verbosity,
+		Observer:  options.Observer,
+	}
+	if err := libify.Main(ctx, libifyOptions); err != nil {
 		return errors.WithStack(err)
 	}
 
+	if err := l.commit(phaseLibify); err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch {
+	case options.Init:
+		if err := l.markPristine(); err != nil {
+			return errors.WithStack(err)
+		}
+	case options.Upgrade:
+		if err := l.finishUpgrade(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+func (l *libgoer) progress() libify.Progress {
+	return libify.Progress{Out: l.options.Out, Verbosity: l.options.Verbosity, Observer: l.options.Observer}
+}
+
 type libgoer struct {
-	options Options
-	pkgs    []*decorator.Package
-	repo    *git.Repository
+	options     Options
+	goVersion   string // Go version of the source tree
+	goCmd       string // go command used to load the source tree
+	include     []*regexp.Regexp
+	exclude     []*regexp.Regexp
+	vendored    []string           // module paths of the vendored packages that were extracted
+	dirs        []string           // package paths (without _test) of the extracted dirs
+	testsLoaded map[string]bool    // package paths (without _test) that had test files loaded
+	embeds      map[string]*embeds // package paths (without _test) -> go:embed patterns and files
+	branch      string             // branch being upgraded
+	pristine    string             // hash of the pristine branch before an upgrade, while it can be aborted
+	pkgs        []*decorator.Package
+	repo        *git.Repository
 }
 
+// reset hard resets the root dir so libify can be run again on the extracted tree (e.g. with a new
+// version of libify). If the branch has a commit from a previous libify run, it must be HEAD, and is
+// dropped. Once there are commits after it (local changes, or the merge made by an upgrade), the
+// tree can't be returned to its state before libify without losing them, so reset fails and the
+// error points at upgrade, which extracts and libifies on the pristine branch and merges the result
+// with the local changes.
 func (l *libgoer) reset() error {
-	fmt.Println("reset")
-	defer fmt.Println("reset done")
+	defer l.progress().Phase("reset")()
+
+	if !l.options.Force {
+		if err := l.checkManifest(); err != nil {
+			return err
+		}
+	}
 
 	r, err := git.PlainOpen(l.options.RootDir)
 	if err != nil {
@@ -97,36 +214,45 @@ func (l *libgoer) reset() error {
 		return errors.WithStack(err)
 	}
 
-	if err := w.Reset(&git.ResetOptions{Commit: h.Hash(), Mode: git.HardReset}); err != nil {
-		return errors.WithStack(err)
-	}
-	return nil
-}
-
-func (l *libgoer) commit() error {
-	fmt.Println("commit")
-	defer fmt.Println("commit done")
-
-	w, err := l.repo.Worktree()
+	// libify is run again, so the commit from a previous libify run is dropped
+	hash := h.Hash()
+	last, err := lastPhaseCommit(r, hash, phaseLibify)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-
-	if _, err := w.Add("."); err != nil {
-		return errors.WithStack(err)
+	if last != nil {
+		if last.Hash != hash {
+			return errors.Errorf("%s has commits after the %q commit %s (local changes or an upgrade merge), so libify can't be run again on it: run with upgrade to libify on %s and merge the result, or rebase to drop the commits", l.options.RootDir, commitPrefix+phaseLibify, last.Hash, PristineBranch)
+		}
+		if last.NumParents() > 0 {
+			hash = last.ParentHashes[0]
+		}
 	}
 
-	options := &git.CommitOptions{Author: &object.Signature{When: time.Now()}}
-	if _, err := w.Commit("init", options); err != nil {
+	if err := w.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset}); err != nil {
 		return errors.WithStack(err)
 	}
+	return nil
+}
 
+// copyFiles copies the files in the extracted package dirs without any changes
+func (l *libgoer) copyFiles() error {
+	defer l.progress().Phase("copyFiles")()
+
+	for _, p := range l.dirs {
+		if err := l.copyPackageFiles(p, nil, false); err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	return nil
 }
 
+// save writes the files in Syntax, and rewrites the imports of the other files in the extracted
+// package dirs.
 func (l *libgoer) save() error {
-	fmt.Println("save")
-	defer fmt.Println("save done")
+	defer l.progress().Phase("save")()
+
+	written := map[string]bool{} // file paths in the root dir written from Syntax
 
 	for _, pkg := range l.pkgs {
 		if len(pkg.Syntax) == 0 {
@@ -137,16 +263,9 @@ func (l *libgoer) save() error {
 		}
 		pkgPathNoTest := strings.TrimSuffix(pkg.PkgPath, "_test")
 
-		newPathWithTest := path.Join(l.options.RootPath, pkg.PkgPath)
+		newPathWithTest := l.convertPath(pkg.PkgPath)
+		newDir := l.convertDir(pkgPathNoTest)
 
-		oldDir := filepath.Join(build.Default.GOROOT, "src", pkgPathNoTest)
-		newDir := filepath.Join(l.options.RootDir, pkgPathNoTest)
-
-		if fi, err := os.Stat(filepath.Join(oldDir, "testdata")); err == nil && fi.IsDir() {
-			if err := Copy(filepath.Join(oldDir, "testdata"), filepath.Join(newDir, "testdata")); err != nil {
-				return errors.WithStack(err)
-			}
-		}
 		if err := os.MkdirAll(newDir, 0777); err != nil {
 			return errors.WithStack(err)
 		}
@@ -158,90 +277,243 @@ func (l *libgoer) save() error {
 			if err := res.Fprint(buf, file); err != nil {
 				return errors.WithStack(err)
 			}
-			if err := ioutil.WriteFile(fpath, buf.Bytes(), 0666); err != nil {
+			if err := ioutil.WriteFile(fpath, l.rewriteLinknames(buf.Bytes()), 0666); err != nil {
 				return errors.WithStack(err)
 			}
+			written[fpath] = true
+		}
+	}
+
+	for _, p := range l.dirs {
+		if err := l.copyPackageFiles(p, written, true); err != nil {
+			return errors.WithStack(err)
 		}
 	}
 	return nil
 }
 
+// findDirs finds the extracted package dirs, which of them had tests loaded, the files they embed,
+// and the vendored packages.
+func (l *libgoer) findDirs() {
+	l.testsLoaded = map[string]bool{}
+	l.embeds = map[string]*embeds{}
+	done := map[string]bool{}
+	for _, pkg := range l.pkgs {
+		if len(pkg.Syntax) == 0 {
+			continue
+		}
+		if strings.HasSuffix(pkg.PkgPath, ".test") {
+			continue
+		}
+		pkgPathNoTest := strings.TrimSuffix(pkg.PkgPath, "_test")
+		if !done[pkgPathNoTest] {
+			done[pkgPathNoTest] = true
+			l.dirs = append(l.dirs, pkgPathNoTest)
+			if isVendored(pkgPathNoTest) {
+				l.vendored = append(l.vendored, strings.TrimPrefix(pkgPathNoTest, "vendor/"))
+			}
+		}
+		for _, file := range pkg.Syntax {
+			if strings.HasSuffix(pkg.Decorator.Filenames[file], "_test.go") {
+				l.testsLoaded[pkgPathNoTest] = true
+			}
+		}
+		if len(pkg.EmbedFiles) > 0 {
+			// the test variant embeds the files of the non-test variant, so patterns and files are
+			// merged.
+			e := l.embeds[pkgPathNoTest]
+			if e == nil {
+				e = &embeds{}
+				l.embeds[pkgPathNoTest] = e
+			}
+			e.patterns = append(e.patterns, pkg.EmbedPatterns...)
+			e.files = append(e.files, pkg.EmbedFiles...)
+		}
+	}
+	sort.Strings(l.dirs)
+}
+
+// convertPath returns the path of the package in the extracted module. Vendored packages (e.g.
+// vendor/golang.org/x/net/dns/dnsmessage) are imported by their module path, and the module is
+// added to the vendor dir of the extracted module.
 func (l *libgoer) convertPath(p string) string {
-	if !filter(p) {
+	if !l.filter(p) {
 		return p
 	}
+	if isVendored(p) {
+		return strings.TrimPrefix(p, "vendor/")
+	}
 	return path.Join(l.options.RootPath, p)
 }
 
-func filter(p string) bool {
-	return strings.HasPrefix(p, "cmd/") || strings.HasPrefix(p, "internal/")
+// convertDir returns the dir of the package in the extracted module. Vendored packages end up in
+// the vendor dir of the extracted module, so the path is unchanged.
+func (l *libgoer) convertDir(p string) string {
+	return filepath.Join(l.options.RootDir, filepath.FromSlash(p))
 }
 
-func (l *libgoer) updateImportsAndDisableTests() error {
-	fmt.Println("updateImportsAndDisableTests")
-	defer fmt.Println("updateImportsAndDisableTests done")
+// updateImports converts the package paths of identifiers, and of string literals that refer to
+// symbols in extracted packages (see convertString). go:linkname directives are converted when the
+// files are saved.
+func (l *libgoer) updateImports() error {
+	defer l.progress().Phase("updateImports")()
 
 	for _, pkg := range l.pkgs {
 		for _, file := range pkg.Syntax {
 			dst.Inspect(file, func(n dst.Node) bool {
 				switch n := n.(type) {
 				case *dst.Ident:
-					if n.Path == "" {
-						return true
-					}
-					newPath := l.convertPath(n.Path)
-					if newPath != n.Path {
-						n.Path = newPath
+					if n.Path != "" {
+						n.Path = l.convertPath(n.Path)
 					}
-				case *dst.FuncDecl:
-					tests, ok := l.options.DisableTests[pkg.PkgPath]
-					if !ok {
+				case *dst.BasicLit:
+					if n.Kind != token.STRING {
 						return true
 					}
-					if !tests[n.Name.Name] {
+					s, err := strconv.Unquote(n.Value)
+					if err != nil {
 						return true
 					}
-					skip := &dst.ExprStmt{
-						X: &dst.CallExpr{
-							Fun: &dst.SelectorExpr{
-								X:   dst.NewIdent("t"),
-								Sel: dst.NewIdent("Skip"),
-							},
-						},
+					if converted := l.convertString(s); converted != s {
+						n.Value = strconv.Quote(converted)
 					}
-					skip.Decs.Start.Replace("// test disabled")
-					skip.Decs.Before = dst.EmptyLine
-					skip.Decs.After = dst.EmptyLine
-					n.Body.List = []dst.Stmt{skip}
 				}
 				return true
 			})
+		}
+	}
+	return nil
+}
+
+// disableTests replaces the bodies of the tests, benchmarks and fuzz tests that match the patterns
+// in Options.DisableTests with a call to Skip, and removes the examples that match.
+func (l *libgoer) disableTests() error {
+	defer l.progress().Phase("disableTests")()
 
+	for _, pkg := range l.pkgs {
+		patterns, ok := l.options.DisableTests[pkg.PkgPath]
+		if !ok {
+			continue
+		}
+		matched := map[string]bool{}
+		for _, file := range pkg.Syntax {
+			if !strings.HasSuffix(pkg.Decorator.Filenames[file], "_test.go") {
+				continue
+			}
+			var decls []dst.Decl
+			for _, decl := range file.Decls {
+				n, ok := decl.(*dst.FuncDecl)
+				if !ok || n.Recv != nil {
+					decls = append(decls, decl)
+					continue
+				}
+				pattern, reason, err := matchTest(patterns, n.Name.Name)
+				if err != nil {
+					return errors.Wrapf(err, "disable tests in %s", pkg.PkgPath)
+				}
+				if pattern == "" {
+					decls = append(decls, decl)
+					continue
+				}
+				matched[pattern] = true
+				if strings.HasPrefix(n.Name.Name, "Example") && len(n.Type.Params.List) == 0 {
+					// examples can't be skipped, so they're removed
+					continue
+				}
+				if !skipTest(n, reason) {
+					l.progress().Send(libify.Event{
+						Kind:    libify.WarningFound,
+						Package: pkg.PkgPath,
+						Message: fmt.Sprintf("%s in %s matches %q but has no *testing.T, *testing.B or *testing.F parameter", n.Name.Name, pkg.PkgPath, pattern),
+					})
+				}
+				decls = append(decls, decl)
+			}
+			file.Decls = decls
+		}
+		for pattern := range patterns {
+			// without the test files, nothing can match
+			if !matched[pattern] && l.testsLoaded[strings.TrimSuffix(pkg.PkgPath, "_test")] {
+				l.progress().Send(libify.Event{
+					Kind:    libify.WarningFound,
+					Package: pkg.PkgPath,
+					Message: fmt.Sprintf("disable tests pattern %q matches nothing in %s", pattern, pkg.PkgPath),
+				})
+			}
 		}
 	}
 	return nil
 }
 
+// skipTest replaces the body of a test, benchmark or fuzz test with a call to Skip on its
+// *testing.T, *testing.B or *testing.F parameter. If the parameter is unnamed, it's named. Returns
+// false if there's no such parameter.
+func skipTest(n *dst.FuncDecl, reason string) bool {
+	var name string
+	for _, field := range n.Type.Params.List {
+		star, ok := field.Type.(*dst.StarExpr)
+		if !ok {
+			continue
+		}
+		id, ok := star.X.(*dst.Ident)
+		if !ok || id.Path != "testing" || (id.Name != "T" && id.Name != "B" && id.Name != "F") {
+			continue
+		}
+		if len(field.Names) == 0 {
+			field.Names = []*dst.Ident{dst.NewIdent(strings.ToLower(id.Name))}
+		} else if field.Names[0].Name == "_" {
+			field.Names[0].Name = strings.ToLower(id.Name)
+		}
+		name = field.Names[0].Name
+		break
+	}
+	if name == "" {
+		return false
+	}
+	if reason == "" {
+		reason = "disabled by libgo"
+	}
+	skip := &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(name),
+				Sel: dst.NewIdent("Skip"),
+			},
+			Args: []dst.Expr{&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(reason)}},
+		},
+	}
+	skip.Decs.Start.Replace("// test disabled")
+	skip.Decs.Before = dst.EmptyLine
+	skip.Decs.After = dst.EmptyLine
+	n.Body.List = []dst.Stmt{skip}
+	return true
+}
+
 func (l *libgoer) load(ctx context.Context) error {
-	fmt.Println("load")
-	defer fmt.Println("load done")
+	defer l.progress().Phase("load")()
 
-	dir := filepath.Join(build.Default.GOROOT, "src", l.options.From)
+	dir := filepath.Join(l.goroot(), "src", l.options.From)
 	pth := l.options.From
 
 	start := time.Now()
-	paths, err := libify.LoadAllPackages(ctx, pth, dir, l.options.Tests, filter)
+	paths, err := libify.LoadPackages(ctx, libify.LoadOptions{
+		Paths:  []string{pth},
+		Dir:    dir,
+		Env:    l.env(),
+		Tests:  l.options.Tests,
+		Filter: l.filter,
+	})
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	end := time.Now()
-	fmt.Printf("Loaded %d paths in %v seconds\n", len(paths), end.Sub(start).Seconds())
+	l.progress().Send(libify.Event{Kind: libify.PackagesLoaded, Phase: "load paths", Count: len(paths), Duration: time.Since(start)})
 
 	cfg := &packages.Config{
-		Mode:    packages.LoadSyntax,
+		Mode:    packages.LoadSyntax | packages.NeedEmbedFiles | packages.NeedEmbedPatterns,
 		Tests:   l.options.Tests,
 		Context: ctx,
 		Dir:     dir,
+		Env:     l.env(),
 	}
 
 	start = time.Now()
@@ -249,8 +521,7 @@ func (l *libgoer) load(ctx context.Context) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	end = time.Now()
-	fmt.Printf("Loaded %d packages in %v seconds\n", len(paths), end.Sub(start).Seconds())
+	l.progress().Send(libify.Event{Kind: libify.PackagesLoaded, Phase: "load packages", Count: len(pkgs), Duration: time.Since(start)})
 
 	m := map[string]*decorator.Package{}
 
@@ -292,12 +563,13 @@ func (l *libgoer) load(ctx context.Context) error {
 		l.pkgs = append(l.pkgs, p)
 	}
 
+	l.findDirs()
+
 	return nil
 }
 
 func (l *libgoer) prepDir() error {
-	fmt.Println("prepDir")
-	defer fmt.Println("prepDir done")
+	defer l.progress().Phase("prepDir")()
 
 	if fi, err := os.Stat(l.options.RootDir); err == nil && fi.IsDir() {
 		// don't delete the dir, or the terminal will grumble
@@ -305,6 +577,14 @@ func (l *libgoer) prepDir() error {
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		if len(fis) > 0 && !l.options.Force {
+			if _, err := ReadManifest(l.options.RootDir); err != nil {
+				if os.IsNotExist(err) {
+					return errors.Errorf("refusing to clear %s: it is not empty and has no %s file, so wasn't created by libgo (use force to clear it anyway)", l.options.RootDir, ManifestName)
+				}
+				return errors.WithStack(err)
+			}
+		}
 		for _, fi := range fis {
 			fpath := filepath.Join(l.options.RootDir, fi.Name())
 			if err := os.RemoveAll(fpath); err != nil {
@@ -315,6 +595,9 @@ func (l *libgoer) prepDir() error {
 	if err := os.MkdirAll(l.options.RootDir, 0777); err != nil {
 		return errors.WithStack(err)
 	}
+	if err := l.writeManifest(); err != nil {
+		return errors.WithStack(err)
+	}
 	r, err := git.PlainInit(l.options.RootDir, false)
 	if err != nil {
 		return errors.WithStack(err)
@@ -324,10 +607,20 @@ func (l *libgoer) prepDir() error {
 }
 
 type Options struct {
-	From         string // package path of command we need to extract - e.g. "cmd/compile"
-	RootPath     string // package path of module root
-	RootDir      string // dir of module root
-	DisableTests map[string]map[string]bool
-	Init         bool
-	Tests        bool
+	From         string                       `json:"from,omitempty"`          // package path of command we need to extract - e.g. "cmd/compile"
+	Goroot       string                       `json:"goroot,omitempty"`        // Go source tree to extract from (default build.Default.GOROOT)
+	RootPath     string                       `json:"root_path,omitempty"`     // package path of module root
+	RootDir      string                       `json:"root_dir,omitempty"`      // dir of module root
+	DisableTests map[string]map[string]string `json:"disable_tests,omitempty"` // package path -> test name pattern (see matchTest) -> reason
+	Include      []string                     `json:"include,omitempty"`       // patterns of packages to extract (default DefaultInclude)
+	Exclude      []string                     `json:"exclude,omitempty"`       // patterns of packages to leave out, even if included
+	Init         bool                         `json:"init,omitempty"`
+	Upgrade      bool                         `json:"upgrade,omitempty"`      // extract onto the pristine branch, then merge it into the current branch (needs git in PATH)
+	AuthorName   string                       `json:"author_name,omitempty"`  // author of the commits (default "libgo")
+	AuthorEmail  string                       `json:"author_email,omitempty"` // email of the author of the commits (default "libgo@localhost")
+	Force        bool                         `json:"force,omitempty"`        // clear RootDir on init even if it wasn't created by libgo, and skip the manifest check otherwise
+	Tests        bool                         `json:"tests,omitempty"`        // also libify the test packages (see the note on Presets)
+	Out          io.Writer                    `json:"-"`                      // progress is printed to Out (default os.Stdout)
+	Verbosity    libify.Verbosity             `json:"-"`                      // controls which progress events are printed
+	Observer     func(libify.Event)           `json:"-"`                      // if set, is called with every progress event
 }
@@ -0,0 +1,225 @@
+package libgo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dave/libify"
+	"github.com/pkg/errors"
+)
+
+// rewriteLinknames converts the package paths of go:linkname targets in a Go source file (e.g.
+// "//go:linkname foo cmd/internal/objabi.foo"). Only lines that start with a directive are changed.
+func (l *libgoer) rewriteLinknames(src []byte) []byte {
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	for i, line := range lines {
+		if !bytes.HasPrefix(line, []byte("//go:linkname ")) {
+			continue
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) != 3 {
+			continue
+		}
+		p, name := splitSymbol(fields[2])
+		if p == "" {
+			continue
+		}
+		newPath := l.convertPath(p)
+		if newPath == p {
+			continue
+		}
+		lines[i] = bytes.Replace(line, []byte(fields[2]), []byte(newPath+"."+name), 1)
+	}
+	return bytes.Join(lines, nil)
+}
+
+// asmSymbol matches a fully qualified symbol in an assembly file, e.g. "internal∕abi·FuncPCTestFn".
+// "∕" is the division slash and "·" is the middle dot.
+var asmSymbol = regexp.MustCompile(`((?:[A-Za-z0-9_]+∕)*[A-Za-z0-9_]+)·`)
+
+// rewriteAsm converts the fully qualified symbols in an assembly file of package p. Symbols in p
+// are made package relative ("·FuncPCTestFn"). Symbols in other extracted packages can't be
+// converted, because the assembler doesn't allow the dots in the new package path, so they're
+// reported as warnings.
+func (l *libgoer) rewriteAsm(p, fpath string, src []byte) []byte {
+	return asmSymbol.ReplaceAllFunc(src, func(b []byte) []byte {
+		symbolPath := strings.Replace(strings.TrimSuffix(string(b), "·"), "∕", "/", -1)
+		if symbolPath == p {
+			return []byte("·")
+		}
+		if l.convertPath(symbolPath) != symbolPath {
+			l.progress().Send(libify.Event{
+				Kind:    libify.WarningFound,
+				Package: p,
+				Message: fmt.Sprintf("%s refers to %s, which can't be written in assembly after it moves to %s", fpath, string(b), l.convertPath(symbolPath)),
+			})
+		}
+		return b
+	})
+}
+
+// convertString converts a string literal that refers to a symbol in an extracted cmd package: the
+// argument of the -X linker flag (e.g. "-X=cmd/internal/objabi.buildID=..." or
+// "cmd/internal/objabi.buildID=..."), or a symbol name (e.g. "cmd/trace.hidden1"). Symbol names are
+// only converted if the package declares the name, so paths like "cmd/go.sum" are left alone.
+// Strings that refer to internal packages are left alone, because the compiler and linker use them
+// to refer to packages of the program being built, not their own.
+func (l *libgoer) convertString(s string) string {
+	var prefix string
+	for _, x := range []string{"-X=", "-X "} {
+		if strings.HasPrefix(s, x) {
+			prefix = x
+			s = strings.TrimPrefix(s, x)
+		}
+	}
+	symbol, value := s, ""
+	if i := strings.Index(s, "="); i > -1 {
+		symbol, value = s[:i], s[i:]
+	}
+	p, name := splitSymbol(symbol)
+	if p == "" || !strings.HasPrefix(p, "cmd/") || !identifier.MatchString(name) {
+		return prefix + s
+	}
+	if prefix == "" && value == "" && !l.declared(p, name) {
+		return prefix + s
+	}
+	newPath := l.convertPath(p)
+	if newPath == p {
+		return prefix + s
+	}
+	return prefix + newPath + "." + name + value
+}
+
+// declared returns true if the loaded package p declares name at package level
+func (l *libgoer) declared(p, name string) bool {
+	for _, pkg := range l.pkgs {
+		if pkg.PkgPath == p && pkg.Types != nil && pkg.Types.Scope().Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// splitSymbol splits a linker symbol name (e.g. "cmd/internal/objabi.foo") into the package path
+// and the name. The package path may contain dots in the last element, so the split is at the first
+// dot after the last slash.
+func splitSymbol(symbol string) (p, name string) {
+	slash := strings.LastIndex(symbol, "/")
+	dot := strings.Index(symbol[slash+1:], ".")
+	if dot == -1 {
+		return "", ""
+	}
+	dot += slash + 1
+	return symbol[:dot], symbol[dot+1:]
+}
+
+// checkLinknames warns about go:linkname directives that can't be satisfied after extraction:
+//
+//   - the runtime implements some functions in extracted packages (e.g. internal/sync) by pushing
+//     them with "//go:linkname x internal/sync.y". After extraction the package path doesn't match,
+//     so the function has no body.
+//   - extracted packages that pull a runtime symbol the runtime doesn't mark as pushed are rejected
+//     by the linker when they're outside the standard library.
+func (l *libgoer) checkLinknames() error {
+	defer l.progress().Phase("checkLinknames")()
+
+	runtimeDir := filepath.Join(l.goroot(), "src", "runtime")
+	runtimeLinknames, err := readLinknames(runtimeDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	extracted := map[string]bool{}
+	for _, p := range l.dirs {
+		extracted[p] = true
+	}
+	pushed := map[string]bool{} // runtime symbols that allow pulling, e.g. "runtime.fastrand"
+	for _, ln := range runtimeLinknames {
+		switch len(ln.args) {
+		case 1:
+			pushed["runtime."+ln.args[0]] = true
+		case 2:
+			pushed[ln.args[1]] = true
+			p, _ := splitSymbol(ln.args[1])
+			if extracted[p] && l.convertPath(p) != p {
+				l.progress().Send(libify.Event{
+					Kind:    libify.WarningFound,
+					Package: p,
+					Message: fmt.Sprintf("%s: the runtime provides %s with go:linkname, which won't be satisfied after %s moves to %s", ln.pos, ln.args[1], p, l.convertPath(p)),
+				})
+			}
+		}
+	}
+
+	for _, p := range l.dirs {
+		linknames, err := readLinknames(filepath.Join(l.goroot(), "src", filepath.FromSlash(p)))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, ln := range linknames {
+			if len(ln.args) != 2 {
+				continue
+			}
+			target, _ := splitSymbol(ln.args[1])
+			if target != "runtime" && !strings.HasPrefix(target, "runtime/") {
+				continue
+			}
+			if pushed[ln.args[1]] {
+				continue
+			}
+			l.progress().Send(libify.Event{
+				Kind:    libify.WarningFound,
+				Package: p,
+				Message: fmt.Sprintf("%s: go:linkname into the runtime (%s) will be rejected by the linker outside the standard library", ln.pos, ln.args[1]),
+			})
+		}
+	}
+	return nil
+}
+
+type linkname struct {
+	pos  string   // file:line
+	args []string // local name, and the optional target
+}
+
+// readLinknames reads the go:linkname directives in the Go files in dir (ignoring build
+// constraints)
+func readLinknames(dir string) ([]linkname, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var linknames []linkname
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".go") || strings.HasSuffix(fi.Name(), "_test.go") {
+			continue
+		}
+		fpath := filepath.Join(dir, fi.Name())
+		f, err := os.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		var line int
+		for scanner.Scan() {
+			line++
+			if !strings.HasPrefix(scanner.Text(), "//go:linkname ") {
+				continue
+			}
+			fields := strings.Fields(scanner.Text())
+			linknames = append(linknames, linkname{pos: fmt.Sprintf("%s:%d", fpath, line), args: fields[1:]})
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return linknames, nil
+}
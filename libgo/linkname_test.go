@@ -0,0 +1,164 @@
+package libgo
+
+import (
+	"go/types"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst/decorator"
+	"github.com/dave/libify"
+	"golang.org/x/tools/go/packages"
+)
+
+// newLinknameTestLibgoer returns a libgoer that extracts the default packages to example.com/go,
+// with cmd/internal/objabi loaded and declaring buildID. Warnings are appended to warnings.
+func newLinknameTestLibgoer(warnings *[]string) *libgoer {
+	objabi := types.NewPackage("cmd/internal/objabi", "objabi")
+	objabi.Scope().Insert(types.NewVar(0, objabi, "buildID", types.Typ[types.String]))
+	return &libgoer{
+		options: Options{
+			RootPath: "example.com/go",
+			Out:      ioutil.Discard,
+			Observer: func(e libify.Event) {
+				if e.Kind == libify.WarningFound && warnings != nil {
+					*warnings = append(*warnings, e.Message)
+				}
+			},
+		},
+		include: compilePatterns(nil, DefaultInclude),
+		pkgs: []*decorator.Package{{
+			Package: &packages.Package{PkgPath: "cmd/internal/objabi", Types: objabi},
+		}},
+	}
+}
+
+func TestSplitSymbol(t *testing.T) {
+	tests := []struct {
+		symbol, p, name string
+	}{
+		{"cmd/internal/objabi.foo", "cmd/internal/objabi", "foo"},
+		{"runtime.main", "runtime", "main"},
+		{"cmd/compile/internal/ssa.(*Func).Fatalf", "cmd/compile/internal/ssa", "(*Func).Fatalf"},
+		{"golang.org/x/arch/x86.Foo", "golang.org/x/arch/x86", "Foo"},
+		{"cmd/go.sum", "cmd/go", "sum"},
+		{"cmd/internal/objabi", "", ""},
+		{"foo", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		p, name := splitSymbol(test.symbol)
+		if p != test.p || name != test.name {
+			t.Errorf("%q: expected %q, %q, got %q, %q", test.symbol, test.p, test.name, p, name)
+		}
+	}
+}
+
+func TestConvertString(t *testing.T) {
+	tests := []struct {
+		s, expected string
+	}{
+		// -X flags
+		{"-X=cmd/internal/objabi.buildID=abc", "-X=example.com/go/cmd/internal/objabi.buildID=abc"},
+		{"-X cmd/internal/objabi.buildID=abc", "-X example.com/go/cmd/internal/objabi.buildID=abc"},
+		{"cmd/internal/objabi.buildID=", "example.com/go/cmd/internal/objabi.buildID="},
+		{"-X=cmd/internal/objabi.undeclared=abc", "-X=example.com/go/cmd/internal/objabi.undeclared=abc"},
+		// symbol names
+		{"cmd/internal/objabi.buildID", "example.com/go/cmd/internal/objabi.buildID"},
+		{"cmd/internal/objabi.undeclared", "cmd/internal/objabi.undeclared"},
+		{"cmd/internal/objabi.(*T).m", "cmd/internal/objabi.(*T).m"},
+		// file names and paths
+		{"cmd/go.sum", "cmd/go.sum"},
+		{"cmd/go.mod", "cmd/go.mod"},
+		{"cmd/link/internal/ld/testdata/issue26237/b.dir", "cmd/link/internal/ld/testdata/issue26237/b.dir"},
+		{"cmd/internal/objabi", "cmd/internal/objabi"},
+		// other packages
+		{"-X=internal/buildcfg.version=1", "-X=internal/buildcfg.version=1"},
+		{"-X=main.version=1", "-X=main.version=1"},
+		{"runtime.main", "runtime.main"},
+		{"", ""},
+	}
+	l := newLinknameTestLibgoer(nil)
+	for _, test := range tests {
+		if found := l.convertString(test.s); found != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.s, test.expected, found)
+		}
+	}
+}
+
+func TestRewriteLinknames(t *testing.T) {
+	src := strings.Join([]string{
+		"package a",
+		"",
+		"//go:linkname foo cmd/internal/objabi.foo",
+		"//go:linkname bar internal/abi.Bar",
+		"//go:linkname baz runtime.baz",
+		"//go:linkname qux",
+		"//go:linkname quux cmd/internal/objabi",
+		"// go:linkname notadirective cmd/internal/objabi.x",
+		"var s = \"//go:linkname foo cmd/internal/objabi.foo\"",
+		"",
+	}, "\n")
+	expected := strings.Join([]string{
+		"package a",
+		"",
+		"//go:linkname foo example.com/go/cmd/internal/objabi.foo",
+		"//go:linkname bar example.com/go/internal/abi.Bar",
+		"//go:linkname baz runtime.baz",
+		"//go:linkname qux",
+		"//go:linkname quux cmd/internal/objabi",
+		"// go:linkname notadirective cmd/internal/objabi.x",
+		"var s = \"//go:linkname foo cmd/internal/objabi.foo\"",
+		"",
+	}, "\n")
+	l := newLinknameTestLibgoer(nil)
+	if found := string(l.rewriteLinknames([]byte(src))); found != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, found)
+	}
+}
+
+func TestRewriteAsm(t *testing.T) {
+	tests := []struct {
+		name, src, expected string
+		warnings            []string
+	}{
+		{
+			name:     "own package",
+			src:      "TEXT internal∕abi·FuncPCTestFn(SB),NOSPLIT,$0-8",
+			expected: "TEXT ·FuncPCTestFn(SB),NOSPLIT,$0-8",
+		},
+		{
+			name:     "already package relative",
+			src:      "CALL ·helper(SB)",
+			expected: "CALL ·helper(SB)",
+		},
+		{
+			name:     "runtime",
+			src:      "CALL runtime·entersyscall(SB)",
+			expected: "CALL runtime·entersyscall(SB)",
+		},
+		{
+			name:     "other extracted package",
+			src:      "CALL internal∕cpu·Initialize(SB)",
+			expected: "CALL internal∕cpu·Initialize(SB)",
+			warnings: []string{"a.s refers to internal∕cpu·, which can't be written in assembly after it moves to example.com/go/internal/cpu"},
+		},
+		{
+			name:     "several on a line",
+			src:      "MOVQ internal∕abi·x(SB), AX; CALL internal∕abi·y(SB); CALL runtime·z(SB)",
+			expected: "MOVQ ·x(SB), AX; CALL ·y(SB); CALL runtime·z(SB)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var warnings []string
+			l := newLinknameTestLibgoer(&warnings)
+			if found := string(l.rewriteAsm("internal/abi", "a.s", []byte(test.src))); found != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, found)
+			}
+			if strings.Join(warnings, "\n") != strings.Join(test.warnings, "\n") {
+				t.Errorf("expected warnings:\n%s\ngot:\n%s", strings.Join(test.warnings, "\n"), strings.Join(warnings, "\n"))
+			}
+		})
+	}
+}
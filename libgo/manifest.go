@@ -0,0 +1,77 @@
+package libgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestName is the name of the manifest file that libgo writes to the root of the dirs it
+// manages. prepDir refuses to clear a non-empty dir without one (unless Options.Force is set).
+const ManifestName = ".libgo.json"
+
+// Manifest records where an extracted tree came from
+type Manifest struct {
+	Goroot    string `json:"goroot"`     // GOROOT the command was extracted from
+	GoVersion string `json:"go_version"` // Go version of the GOROOT
+	From      string `json:"from"`       // package path of the extracted command - e.g. "cmd/compile"
+	RootPath  string `json:"root_path"`  // package path of module root
+}
+
+// ReadManifest reads the manifest in dir. If there's no manifest, the error satisfies os.IsNotExist.
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", filepath.Join(dir, ManifestName))
+	}
+	return m, nil
+}
+
+// WriteManifest writes the manifest to dir
+func WriteManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ManifestName), append(b, '\n'), 0666); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// checkManifest returns an error if dir isn't managed by libgo, or was extracted from a different
+// command.
+func (l *libgoer) checkManifest() error {
+	m, err := ReadManifest(l.options.RootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("%s is not managed by libgo (no %s file) - run with init to extract", l.options.RootDir, ManifestName)
+		}
+		return errors.WithStack(err)
+	}
+	if m.From != l.options.From {
+		return errors.Errorf("%s contains %s, not %s", l.options.RootDir, m.From, l.options.From)
+	}
+	if m.RootPath != l.options.RootPath {
+		return errors.Errorf("%s has root path %s, not %s", l.options.RootDir, m.RootPath, l.options.RootPath)
+	}
+	return nil
+}
+
+// writeManifest writes the manifest for the current extraction to the root dir
+func (l *libgoer) writeManifest() error {
+	m := &Manifest{
+		Goroot:    l.goroot(),
+		GoVersion: l.goVersion,
+		From:      l.options.From,
+		RootPath:  l.options.RootPath,
+	}
+	return WriteManifest(l.options.RootDir, m)
+}
@@ -0,0 +1,117 @@
+package libgo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestReset(t *testing.T) {
+	tests := []struct {
+		name    string
+		commits []string // after "libgo: copy"
+		merge   bool     // finish with a merge of the last commit, like upgrade
+		head    string   // subject of HEAD after reset
+		err     string
+	}{
+		{
+			name: "no libify commit",
+			head: "libgo: copy",
+		},
+		{
+			name:    "libify at head",
+			commits: []string{"libgo: libify"},
+			head:    "libgo: copy",
+		},
+		{
+			name:    "local changes after libify",
+			commits: []string{"libgo: libify", "local change"},
+			err:     "run with upgrade",
+		},
+		{
+			name:    "upgrade merge after libify",
+			commits: []string{"libgo: libify"},
+			merge:   true,
+			err:     "run with upgrade",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "libgo-reset")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			r, err := git.PlainInit(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := r.Worktree()
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := &libgoer{options: Options{RootDir: dir, Force: true, Out: ioutil.Discard}}
+			commit := func(message string, parents ...plumbing.Hash) plumbing.Hash {
+				if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte(message), 0666); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Add("."); err != nil {
+					t.Fatal(err)
+				}
+				hash, err := w.Commit(message+"\n", &git.CommitOptions{Author: l.author(), Parents: parents})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return hash
+			}
+
+			first := commit("libgo: copy")
+			var last plumbing.Hash
+			for _, message := range test.commits {
+				last = commit(message)
+			}
+			if test.merge {
+				// the merged commit is on a separate branch from the copy commit, like the pristine branch
+				if err := w.Reset(&git.ResetOptions{Commit: first, Mode: git.HardReset}); err != nil {
+					t.Fatal(err)
+				}
+				other := commit("libgo: libify")
+				if err := w.Reset(&git.ResetOptions{Commit: last, Mode: git.HardReset}); err != nil {
+					t.Fatal(err)
+				}
+				h, err := r.Head()
+				if err != nil {
+					t.Fatal(err)
+				}
+				commit("libgo: upgrade to go1.99", h.Hash(), other)
+			}
+
+			err = l.reset()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := r.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := r.CommitObject(h.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject := strings.TrimSpace(c.Message); subject != test.head {
+				t.Errorf("expected HEAD %q, got %q", test.head, subject)
+			}
+		})
+	}
+}
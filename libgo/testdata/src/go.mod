@@ -0,0 +1,18 @@
+module std
+
+go 1.22
+
+require golang.org/x/crypto v0.16.1-0.20231129163542-152cdb1503eb
+
+require (
+	golang.org/x/net v0.19.0
+	golang.org/x/sys v0.15.0 // indirect
+
+	golang.org/x/text v0.14.0 // indirect
+)
+
+replace golang.org/x/net => ./net
+
+replace golang.org/x/tools => ./tools
+
+exclude golang.org/x/sys v0.14.0
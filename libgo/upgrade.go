@@ -0,0 +1,179 @@
+package libgo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// PristineBranch is the branch that only contains libgo commits. Init creates it, and upgrade
+// extracts the new release onto it, then merges it into the current branch, which may contain
+// local changes.
+const PristineBranch = "libgo-pristine"
+
+// ConflictError is returned by an upgrade if merging the new release into the current branch
+// conflicts. The merge is left in progress, so the conflicts can be resolved and committed.
+type ConflictError struct {
+	Branch string
+	Files  []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("merging %s into %s conflicts in %d files:\n%s", PristineBranch, e.Branch, len(e.Files), strings.Join(e.Files, "\n"))
+}
+
+// markPristine points the pristine branch at HEAD
+func (l *libgoer) markPristine() error {
+	h, err := l.repo.Head()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(PristineBranch), h.Hash())
+	if err := l.repo.Storer.SetReference(ref); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// startUpgrade checks out the pristine branch and clears the root dir, ready for the new release
+// to be extracted. The current branch is recorded so finishUpgrade can merge into it. go-git can't
+// merge, so upgrades use the git command, which is checked for before anything is changed.
+func (l *libgoer) startUpgrade() error {
+	defer l.progress().Phase("startUpgrade")()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return errors.New("upgrade needs the git command, and there's no git in PATH")
+	}
+
+	if !l.options.Force {
+		if err := l.checkManifest(); err != nil {
+			return err
+		}
+	}
+
+	status, err := l.git("status", "--porcelain")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if status != "" {
+		return errors.Errorf("%s has uncommitted changes - commit or discard them before upgrading", l.options.RootDir)
+	}
+
+	branch, err := l.git("symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return errors.Wrap(err, "upgrade needs a branch to be checked out")
+	}
+	if branch == PristineBranch {
+		return errors.Errorf("upgrade must be run from the branch with local changes, not %s", PristineBranch)
+	}
+	l.branch = branch
+
+	pristine, err := l.git("rev-parse", "--verify", "refs/heads/"+PristineBranch)
+	if err != nil {
+		return errors.Errorf("%s has no %s branch - it must be created by init before upgrading", l.options.RootDir, PristineBranch)
+	}
+	// from here on, abortUpgrade restores the branches if the upgrade fails
+	l.pristine = pristine
+	if _, err := l.git("checkout", PristineBranch); err != nil {
+		return errors.WithStack(err)
+	}
+
+	fis, err := ioutil.ReadDir(l.options.RootDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, fi := range fis {
+		if fi.Name() == ".git" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(l.options.RootDir, fi.Name())); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := l.writeManifest(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	r, err := git.PlainOpen(l.options.RootDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	l.repo = r
+	return nil
+}
+
+// finishUpgrade checks out the original branch and merges the pristine branch into it. Conflicts
+// are returned as a *ConflictError.
+func (l *libgoer) finishUpgrade() error {
+	defer l.progress().Phase("finishUpgrade")()
+
+	if _, err := l.git("checkout", l.branch); err != nil {
+		return errors.WithStack(err)
+	}
+	// a failed merge is left for the user to resolve, so it isn't aborted
+	l.pristine = ""
+	author := l.author()
+	_, mergeErr := l.git(
+		"-c", "user.name="+author.Name,
+		"-c", "user.email="+author.Email,
+		"merge", "--no-edit", "-m", commitPrefix+"upgrade to "+l.goVersion, PristineBranch,
+	)
+	if mergeErr == nil {
+		return nil
+	}
+	out, err := l.git("diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if out == "" {
+		// not a conflict
+		return errors.WithStack(mergeErr)
+	}
+	return &ConflictError{Branch: l.branch, Files: strings.Split(out, "\n")}
+}
+
+// git runs the git command in the root dir, and returns the trimmed stdout
+func (l *libgoer) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = l.options.RootDir
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// abortUpgrade undoes a failed upgrade: the changes and commits made on the pristine branch are
+// discarded, the original branch is checked out, and the pristine branch is moved back to where it
+// was. It does nothing if startUpgrade didn't get as far as checking out the pristine branch, or if
+// finishUpgrade has started merging. startUpgrade checks there are no uncommitted changes, so the
+// only untracked files are from the failed extraction.
+func (l *libgoer) abortUpgrade() error {
+	if l.pristine == "" {
+		return nil
+	}
+	defer l.progress().Phase("abortUpgrade")()
+
+	for _, args := range [][]string{
+		{"reset", "--hard"},
+		{"clean", "-fd"},
+		{"checkout", l.branch},
+		{"update-ref", "refs/heads/" + PristineBranch, l.pristine},
+	} {
+		if _, err := l.git(args...); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	l.pristine = ""
+	return nil
+}
@@ -0,0 +1,89 @@
+package libgo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestUpgradeFailureRestoresBranch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git in PATH")
+	}
+	dir, err := ioutil.TempDir("", "libgo-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := Options{
+		From:     "cmd/libgo-missing", // loading fails after the pristine branch is checked out
+		RootPath: "example.com/go",
+		RootDir:  dir,
+		Upgrade:  true,
+		Force:    true,
+		Out:      ioutil.Discard,
+	}
+	if err := (&libgoer{options: options}).checkGoroot(); err != nil {
+		t.Skip(err)
+	}
+
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "local.go"), []byte("package local\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	l := &libgoer{options: options}
+	hash, err := w.Commit("local", &git.CommitOptions{Author: l.author()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pristine := plumbing.NewHashReference(plumbing.NewBranchReferenceName(PristineBranch), hash)
+	if err := r.Storer.SetReference(pristine); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Main(context.Background(), options); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Name() != plumbing.NewBranchReferenceName("master") {
+		t.Errorf("expected master to be checked out, got %s", head.Name())
+	}
+	ref, err := r.Reference(plumbing.NewBranchReferenceName(PristineBranch), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != hash {
+		t.Errorf("expected %s at %s, got %s", PristineBranch, hash, ref.Hash())
+	}
+	status, err := w.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsClean() {
+		t.Errorf("expected a clean worktree, got:\n%s", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "local.go")); err != nil {
+		t.Errorf("expected local.go to be restored: %v", err)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
@@ -27,78 +29,74 @@ func Main(ctx context.Context, options Options) error {
 		options.Out = os.Stdout
 	}
 
-	l := &libifier{options: options}
-
-	if err := l.load(ctx); err != nil {
-		return errors.WithStack(err)
+	if err := options.validateShim(); err != nil {
+		return err
 	}
 
-	if err := l.findPackageLevelVars(); err != nil {
-		return errors.WithStack(err)
-	}
-
-	if err := l.findUses(); err != nil {
-		return errors.WithStack(err)
-	}
+	l := &libifier{options: options}
 
-	if err := l.findMethods(); err != nil {
+	if err := l.load(ctx); err != nil {
 		return errors.WithStack(err)
 	}
 
-	if err := l.findFuncs(); err != nil {
-		return errors.WithStack(err)
-	}
+	// Each group of passes runs to completion, collecting diagnostics from all packages. Processing
+	// stops after a group if there are any diagnostics.
 
-	if err := l.findFuncUses(); err != nil {
-		return errors.WithStack(err)
+	if err := l.runPasses(
+		pass{"preflight", func() error {
+			if err := l.preflight(); err != nil {
+				return errors.WithStack(err)
+			}
+			return l.reportFindings()
+		}},
+	); err != nil {
+		return err
 	}
 
-	if err := l.findStructTypes(); err != nil {
-		return errors.WithStack(err)
+	if err := l.runPasses(
+		pass{"findPackageLevelVars", l.findPackageLevelVars},
+		pass{"findUses", l.findUses},
+		pass{"findMethods", l.findMethods},
+		pass{"findFuncs", l.findFuncs},
+		pass{"findFuncUses", l.findFuncUses},
+		pass{"findStructTypes", l.findStructTypes},
+		pass{"findAliasTypes", l.findAliasTypes},
+	); err != nil {
+		return err
 	}
 
-	if err := l.findAliasTypes(); err != nil {
-		return errors.WithStack(err)
-	}
+	l.sendPackageCounts()
 
 	// ===== NO READING AFTER HERE ======
 	// ===== NO WRITING BEFORE HERE =====
 
-	// must go first so we get package state import names populated
-	if err := l.addStateFiles(); err != nil {
-		return errors.WithStack(err)
+	passes := []pass{
+		// must go first so we get package state import names populated
+		{"addStateFiles", l.addStateFiles},
+		{"addTestStateFiles", l.addTestStateFiles},
+		{"addStructFields", l.addStructFields},
+		{"updateAliasTypes", l.updateAliasTypes},
+		{"updateFuncs", l.updateFuncs},
+		{"updateMethods", l.updateMethods},
+		{"updateTestFuncs", l.updateTestFuncs},
+		{"updateFuncUses", l.updateFuncUses},
+		{"deleteVars", l.deleteVars},
+		{"updateUses", l.updateUses},
+		{"addProgramStates", l.addProgramStates},
 	}
-
-	if err := l.addStructFields(); err != nil {
-		return errors.WithStack(err)
-	}
-
-	if err := l.updateAliasTypes(); err != nil {
-		return errors.WithStack(err)
-	}
-
-	if err := l.updateFuncs(); err != nil {
-		return errors.WithStack(err)
-	}
-
-	if err := l.updateMethods(); err != nil {
-		return errors.WithStack(err)
-	}
-
-	if err := l.updateFuncUses(); err != nil {
-		return errors.WithStack(err)
-	}
-
-	if err := l.deleteVars(); err != nil {
-		return errors.WithStack(err)
+	if l.options.Library {
+		passes = append(passes, pass{"addInstanceFuncs", l.addInstanceFuncs})
+		if l.options.Shim != "" {
+			passes = append(passes, pass{"addShim", l.addShim})
+		}
+	} else {
+		passes = append(passes, pass{"renameMain", l.renameMain})
 	}
-
-	if err := l.updateUses(); err != nil {
-		return errors.WithStack(err)
+	if l.options.IsolationTests {
+		passes = append(passes, pass{"addIsolationTests", l.addIsolationTests})
 	}
-
-	if err := l.renameMain(); err != nil {
-		return errors.WithStack(err)
+	if err := l.runPasses(passes...); err != nil {
+		return err
 	}
 
 	if err := l.save(); err != nil {
@@ -110,9 +108,42 @@ func Main(ctx context.Context, options Options) error {
 
 // Libifier converts a command line app to a library
 type libifier struct {
-	options  Options
-	paths    []string
-	packages map[string]*libifyPkg
+	options     Options
+	paths       []string
+	packages    map[string]*libifyPkg
+	findings    []Finding
+	pass        string // name of the currently running pass
+	diagnostics Diagnostics
+	shims       []shim
+}
+
+func (l *libifier) progress() Progress {
+	return Progress{Out: l.options.Out, Verbosity: l.options.Verbosity, Observer: l.options.Observer}
+}
+
+// sendPackageCounts sends a PackageCounts event for each package, in path order
+func (l *libifier) sendPackageCounts() {
+	var paths []string
+	for path := range l.packages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		lp := l.packages[path]
+		l.progress().Send(Event{
+			Kind:    PackageCounts,
+			Package: path,
+			Counts: Counts{
+				Vars:     len(lp.packageLevelVarObject),
+				Funcs:    len(lp.funcFuncDecl),
+				Methods:  len(lp.methodFuncDecl),
+				Structs:  len(lp.structTypeSpec),
+				Aliases:  len(lp.aliasTypeSpec),
+				VarUses:  len(lp.varUses),
+				FuncUses: len(lp.funcUses),
+			},
+		})
+	}
 }
 
 func newLibifyPkg(path string) *libifyPkg {
@@ -122,9 +153,12 @@ func newLibifyPkg(path string) *libifyPkg {
 		packageLevelVarObject:        map[types.Object]bool{},
 		packageLevelVarGenDecl:       map[*dst.GenDecl]bool{},
 		packageLevelVarValueSpec:     map[*dst.ValueSpec]bool{},
+		packageLevelVarNames:         map[string]bool{},
 		packageStateImportFieldNames: map[string]string{},
 		funcFuncDecl:                 map[*dst.FuncDecl]bool{},
 		funcObject:                   map[types.Object]bool{},
+		funcNames:                    map[string]bool{},
+		testFuncDecl:                 map[*dst.FuncDecl]bool{},
 		methodFuncDecl:               map[*dst.FuncDecl]bool{},
 		methodObject:                 map[types.Object]bool{},
 		varUses:                      map[*dst.Ident]bool{},
@@ -141,11 +175,15 @@ type libifyPkg struct {
 	path                         string
 	pathNoVendor                 string
 	pkg                          *decorator.Package
-	tst                          *decorator.Package
+	test                         bool      // external test package (e.g. "foo_test")
+	stateFile                    *dst.File // file containing the PackageState type
 	packageLevelVarGenDecl       map[*dst.GenDecl]bool
 	packageLevelVarObject        map[types.Object]bool
+	packageLevelVarNames         map[string]bool
 	funcFuncDecl                 map[*dst.FuncDecl]bool
 	funcObject                   map[types.Object]bool
+	funcNames                    map[string]bool
+	testFuncDecl                 map[*dst.FuncDecl]bool // tests, benchmarks, examples etc.
 	methodFuncDecl               map[*dst.FuncDecl]bool
 	methodObject                 map[types.Object]bool
 	packageLevelVarValueSpec     map[*dst.ValueSpec]bool
@@ -157,13 +195,20 @@ type libifyPkg struct {
 	structObject                 map[types.Object]bool
 	aliasTypeSpec                map[*dst.TypeSpec]bool
 	aliasObject                  map[types.Object]bool
+	instanceFunc                 string        // name of the NewInstance function in library mode
+	testStateFunc                string        // name of the newTestPackageState function
+	programState                 *programState // generated ProgramState of a command or library package
 }
 
 func (l *libifier) addStateFiles() error {
-	fmt.Fprintln(l.options.Out, "addStateFiles")
-	defer fmt.Fprintln(l.options.Out, "addStateFiles done")
 	for _, lp := range l.packages {
 		u := uniqueNamePicker{}
+		if l.options.Style == MethodStyle {
+			// fields and methods of PackageState share a namespace
+			for name := range lp.funcNames {
+				u[name] = true
+			}
+		}
 
 		f := &dst.File{
 			Name: dst.NewIdent(lp.pkg.Name),
@@ -244,8 +289,69 @@ func (l *libifier) addStateFiles() error {
 			},
 		})
 
+		fname := "package-state.go"
+		if lp.test {
+			fname = "package-state-external_test.go"
+		}
+		lp.stateFile = f
+		fpath, ok := l.newFilename(lp, fname)
+		if !ok {
+			continue
+		}
 		lp.pkg.Syntax = append(lp.pkg.Syntax, f)
-		lp.pkg.Decorator.Filenames[f] = filepath.Join(lp.pkg.Dir, "package-state.go")
+		lp.pkg.Decorator.Filenames[f] = fpath
+	}
+	return nil
+}
+
+// addTestStateFiles adds a newTestPackageState function to each package with tests, which creates
+// a fresh package state graph for each test. If the package already declares newTestPackageState, a
+// unique name is picked.
+func (l *libifier) addTestStateFiles() error {
+	for _, lp := range l.packages {
+		if len(lp.testFuncDecl) == 0 {
+			continue
+		}
+		u := uniqueNamePicker{}
+		for _, name := range lp.pkg.Types.Scope().Names() {
+			u[name] = true
+		}
+		lp.testStateFunc = u.pick("newTestPackageState")
+
+		stmts, result := l.generateStateGraph(lp, lp.pathNoVendor)
+		stmts = append(stmts, &dst.ReturnStmt{
+			Results: []dst.Expr{result},
+			Decs:    dst.ReturnStmtDecorations{NodeDecs: dst.NodeDecs{Before: dst.NewLine}},
+		})
+		decl := &dst.FuncDecl{
+			Name: dst.NewIdent(lp.testStateFunc),
+			Type: &dst.FuncType{
+				Params: &dst.FieldList{},
+				Results: &dst.FieldList{
+					List: []*dst.Field{{Type: &dst.StarExpr{X: dst.NewIdent("PackageState")}}},
+				},
+			},
+			Body: &dst.BlockStmt{List: stmts},
+			Decs: dst.FuncDeclDecorations{NodeDecs: dst.NodeDecs{Before: dst.EmptyLine}},
+		}
+
+		if lp.test {
+			// external test packages only exist in tests, so the function can go in the package
+			// state file.
+			lp.stateFile.Decls = append(lp.stateFile.Decls, decl)
+			continue
+		}
+
+		fpath, ok := l.newFilename(lp, "package-state_test.go")
+		if !ok {
+			continue
+		}
+		f := &dst.File{
+			Name:  dst.NewIdent(lp.pkg.Name),
+			Decls: []dst.Decl{decl},
+		}
+		lp.pkg.Syntax = append(lp.pkg.Syntax, f)
+		lp.pkg.Decorator.Filenames[f] = fpath
 	}
 	return nil
 }
@@ -379,23 +485,35 @@ func (l *libifier) generatePackageStateVarFields(lp *libifyPkg, u uniqueNamePick
 			for _, v := range vs.Names {
 				names = append(names, v)
 			}
+			typ, err := l.typeToAstTypeSpec(infoType.Type, lp.path)
+			if err != nil {
+				l.errorf(lp, vs.Type, vs.Names[0].Name, "%v", err)
+				continue
+			}
 			f := &dst.Field{
 				Names: names,
-				Type:  l.typeToAstTypeSpec(infoType.Type, lp.path),
+				Type:  typ,
 			}
 			fields = append(fields, f)
 			continue
 		}
-		// if spec.Type is nil, we must separate the name / value pairs
-		for i, name := range vs.Names {
+		// if spec.Type is nil, we must separate the names and use the type of each var
+		for _, name := range vs.Names {
 			if name.Name == "_" {
 				continue
 			}
-			value := vs.Values[i]
-			infoType := lp.pkg.TypesInfo.Types[lp.pkg.Decorator.Ast.Nodes[value].(ast.Expr)]
+			ob := l.def(lp, name)
+			if ob == nil {
+				continue
+			}
+			typ, err := l.typeToAstTypeSpec(ob.Type(), lp.path)
+			if err != nil {
+				l.errorf(lp, name, name.Name, "%v", err)
+				continue
+			}
 			f := &dst.Field{
 				Names: []*dst.Ident{name},
-				Type:  l.typeToAstTypeSpec(infoType.Type, lp.path),
+				Type:  typ,
 			}
 			fields = append(fields, f)
 		}
@@ -428,12 +546,28 @@ func (l *libifier) generatePackageStateImportFields(lp *libifyPkg, u uniqueNameP
 }
 
 func (l *libifier) updateFuncUses() error {
-	fmt.Fprintln(l.options.Out, "updateFuncs")
-	defer fmt.Fprintln(l.options.Out, "updateFuncs done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
 				switch n := c.Node().(type) {
+				case *dst.Ident:
+					// in method style, A -> pstate.A and b.B -> pstate.b.B, so calls and function
+					// values both use the package state.
+					if !lp.funcUses[n] {
+						return true
+					}
+					lpIdent, ok := l.identPackage(lp, n)
+					if !ok || !l.isMethodFunc(lpIdent, n.Name) {
+						return true
+					}
+					var x dst.Expr = dst.NewIdent("pstate")
+					if n.Path != "" {
+						x = &dst.SelectorExpr{X: x, Sel: dst.NewIdent(lp.packageStateImportFieldNames[n.Path])}
+					}
+					sel := &dst.SelectorExpr{X: x, Sel: dst.NewIdent(n.Name)}
+					sel.Decs.NodeDecs = n.Decs.NodeDecs
+					c.Replace(sel)
+
 				case *dst.CallExpr:
 
 					id, ok := n.Fun.(*dst.Ident)
@@ -443,6 +577,10 @@ func (l *libifier) updateFuncUses() error {
 					if !lp.funcUses[id] {
 						return true
 					}
+					if lpIdent, ok := l.identPackage(lp, id); ok && l.isMethodFunc(lpIdent, id.Name) {
+						// updated when the ident is visited
+						return true
+					}
 
 					if id.Path == "" {
 						param := dst.NewIdent("pstate")
@@ -498,8 +636,6 @@ func (l *libifier) updateFuncUses() error {
 }
 
 func (l *libifier) updateAliasTypes() error {
-	fmt.Fprintln(l.options.Out, "updateAliasTypes")
-	defer fmt.Fprintln(l.options.Out, "updateAliasTypes done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -534,8 +670,6 @@ func (l *libifier) updateAliasTypes() error {
 }
 
 func (l *libifier) addStructFields() error {
-	fmt.Fprintln(l.options.Out, "addStructFields")
-	defer fmt.Fprintln(l.options.Out, "addStructFields done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -558,8 +692,6 @@ func (l *libifier) addStructFields() error {
 }
 
 func (l *libifier) updateMethods() error {
-	fmt.Fprintln(l.options.Out, "updateMethods")
-	defer fmt.Fprintln(l.options.Out, "updateMethods done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -598,9 +730,37 @@ func (l *libifier) updateMethods() error {
 	return nil
 }
 
+func (l *libifier) updateTestFuncs() error {
+	for _, lp := range l.packages {
+		for _, file := range lp.pkg.Syntax {
+			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
+				switch n := c.Node().(type) {
+				case *dst.FuncDecl:
+					if !lp.testFuncDecl[n] {
+						return true
+					}
+					stmts := []dst.Stmt{
+						&dst.AssignStmt{
+							Lhs: []dst.Expr{dst.NewIdent("pstate")},
+							Tok: token.DEFINE,
+							Rhs: []dst.Expr{&dst.CallExpr{Fun: dst.NewIdent(lp.testStateFunc)}},
+						},
+						&dst.AssignStmt{
+							Lhs: []dst.Expr{dst.NewIdent("_")},
+							Tok: token.ASSIGN,
+							Rhs: []dst.Expr{dst.NewIdent("pstate")},
+						},
+					}
+					n.Body.List = append(stmts, n.Body.List...)
+				}
+				return true
+			}, nil)
+		}
+	}
+	return nil
+}
+
 func (l *libifier) updateFuncs() error {
-	fmt.Fprintln(l.options.Out, "updateFuncs")
-	defer fmt.Fprintln(l.options.Out, "updateFuncs done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -613,6 +773,10 @@ func (l *libifier) updateFuncs() error {
 						Names: []*dst.Ident{dst.NewIdent("pstate")},
 						Type:  &dst.StarExpr{X: dst.NewIdent("PackageState")},
 					}
+					if l.isMethodFunc(lp, n.Name.Name) {
+						n.Recv = &dst.FieldList{List: []*dst.Field{f}}
+						return true
+					}
 					n.Type.Params.List = append([]*dst.Field{f}, n.Type.Params.List...)
 				}
 				return true
@@ -622,17 +786,46 @@ func (l *libifier) updateFuncs() error {
 	return nil
 }
 
+// identPackage returns the package that id in lp refers to, and false if it's not being converted
+func (l *libifier) identPackage(lp *libifyPkg, id *dst.Ident) (*libifyPkg, bool) {
+	if id.Path == "" {
+		return lp, true
+	}
+	lpi, ok := l.packages[id.Path]
+	return lpi, ok
+}
+
+// isMethodFunc returns true if the package level function name in lp is converted to a method of
+// the package state
+func (l *libifier) isMethodFunc(lp *libifyPkg, name string) bool {
+	if l.options.Style != MethodStyle {
+		return false
+	}
+	f, ok := lp.pkg.Types.Scope().Lookup(name).(*types.Func)
+	return ok && f.Type().(*types.Signature).TypeParams().Len() == 0
+}
+
 func (l *libifier) deleteVars() error {
-	fmt.Fprintln(l.options.Out, "deleteVars")
-	defer fmt.Fprintln(l.options.Out, "deleteVars done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
 				switch n := c.Node().(type) {
 				case *dst.GenDecl:
-					if lp.packageLevelVarGenDecl[n] {
+					if !lp.packageLevelVarGenDecl[n] {
+						return true
+					}
+					// specs that stay global (e.g. go:embed vars) are kept
+					var keep []dst.Spec
+					for _, spec := range n.Specs {
+						if !lp.packageLevelVarValueSpec[spec.(*dst.ValueSpec)] {
+							keep = append(keep, spec)
+						}
+					}
+					if len(keep) == 0 {
 						c.Delete()
+						return true
 					}
+					n.Specs = keep
 				}
 				return true
 			}, nil)
@@ -642,46 +835,117 @@ func (l *libifier) deleteVars() error {
 }
 
 func (l *libifier) save() error {
-	fmt.Fprintln(l.options.Out, "save")
-	defer fmt.Fprintln(l.options.Out, "save done")
+	defer l.progress().Phase("save")()
 	for _, lp := range l.packages {
 		if err := lp.pkg.SaveWithResolver(guess.New()); err != nil {
 			return errors.WithStack(err)
 		}
 	}
+	if err := l.saveShims(); err != nil {
+		return errors.WithStack(err)
+	}
 	return nil
 }
 
+// renameMain renames the main function of each command to Main
 func (l *libifier) renameMain() error {
-	fmt.Fprintln(l.options.Out, "renameMain")
-	defer fmt.Fprintln(l.options.Out, "renameMain done")
-	lp := l.packages[l.options.Path]
-	for _, file := range lp.pkg.Syntax {
-		var done bool
-		dstutil.Apply(file, func(c *dstutil.Cursor) bool {
-			if done {
-				return false
-			}
-			switch n := c.Node().(type) {
-			case *dst.FuncDecl:
-				if n.Recv != nil {
-					return true
-				}
-				if n.Name.Name == "main" {
-					n.Name.Name = "Main"
-					done = true
+	for _, path := range l.options.commands() {
+		lp, ok := l.packages[path]
+		if !ok {
+			l.diagnostics = append(l.diagnostics, Diagnostic{
+				Pass:    l.pass,
+				Ident:   path,
+				Message: "package not found",
+			})
+			continue
+		}
+		for _, file := range lp.pkg.Syntax {
+			var done bool
+			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
+				if done {
 					return false
 				}
-			}
-			return true
-		}, nil)
+				switch n := c.Node().(type) {
+				case *dst.FuncDecl:
+					if lp.methodFuncDecl[n] {
+						// in method style main has a receiver by now, so only methods of other types
+						// are skipped
+						return true
+					}
+					if n.Name.Name == "main" {
+						n.Name.Name = "Main"
+						done = true
+						return false
+					}
+				}
+				return true
+			}, nil)
+		}
+	}
+	return nil
+}
+
+// addInstanceFuncs adds a libify-instance.go file to each library package, with a NewInstance function
+// that returns the package state from a new ProgramState. If the package already declares
+// NewInstance, a unique name is picked.
+func (l *libifier) addInstanceFuncs() error {
+	for _, path := range l.options.commands() {
+		lp, ok := l.packages[path]
+		if !ok {
+			l.diagnostics = append(l.diagnostics, Diagnostic{
+				Pass:    l.pass,
+				Ident:   path,
+				Message: "package not found",
+			})
+			continue
+		}
+		u := uniqueNamePicker{
+			lp.programState.typeName: true,
+			lp.programState.funcName: true,
+		}
+		for _, name := range lp.pkg.Types.Scope().Names() {
+			u[name] = true
+		}
+		name := u.pick("NewInstance")
+		lp.instanceFunc = name
+
+		// return NewProgramState(nil).Lib
+		stmts := []dst.Stmt{&dst.ReturnStmt{
+			Results: []dst.Expr{&dst.SelectorExpr{
+				X:   &dst.CallExpr{Fun: dst.NewIdent(lp.programState.funcName), Args: []dst.Expr{dst.NewIdent("nil")}},
+				Sel: dst.NewIdent(lp.programState.fields[lp]),
+			}},
+			Decs: dst.ReturnStmtDecorations{NodeDecs: dst.NodeDecs{Before: dst.NewLine, After: dst.NewLine}},
+		}}
+		decl := &dst.FuncDecl{
+			Name: dst.NewIdent(name),
+			Type: &dst.FuncType{
+				Params: &dst.FieldList{},
+				Results: &dst.FieldList{
+					List: []*dst.Field{{Type: &dst.StarExpr{X: dst.NewIdent("PackageState")}}},
+				},
+			},
+			Body: &dst.BlockStmt{List: stmts},
+		}
+		decl.Decs.Before = dst.EmptyLine
+		decl.Decs.Start.Append(fmt.Sprintf("// %s returns a new instance of the package, with its own state and the state of all", name))
+		decl.Decs.Start.Append("// the packages it uses.")
+
+		fpath, ok := l.newFilename(lp, "libify-instance.go")
+		if !ok {
+			continue
+		}
+		f := &dst.File{
+			Name:  dst.NewIdent(lp.pkg.Name),
+			Decls: []dst.Decl{decl},
+		}
+		lp.pkg.Syntax = append(lp.pkg.Syntax, f)
+		lp.pkg.Decorator.Filenames[f] = fpath
 	}
 	return nil
 }
 
 func (l *libifier) updateUses() error {
-	fmt.Fprintln(l.options.Out, "updateUses")
-	defer fmt.Fprintln(l.options.Out, "updateUses done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -715,8 +979,6 @@ func (l *libifier) updateUses() error {
 }
 
 func (l *libifier) findUses() error {
-	fmt.Fprintln(l.options.Out, "findUses")
-	defer fmt.Fprintln(l.options.Out, "findUses done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dst.Inspect(file, func(n dst.Node) bool {
@@ -743,7 +1005,7 @@ func (l *libifier) findUses() error {
 						}
 						lpIdent = lpi
 					}
-					if !lpIdent.packageLevelVarObject[use] {
+					if !isPackageLevel(use) || !lpIdent.packageLevelVarNames[use.Name()] {
 						return true
 					}
 					lp.varUses[n] = true
@@ -756,8 +1018,6 @@ func (l *libifier) findUses() error {
 }
 
 func (l *libifier) findFuncUses() error {
-	fmt.Fprintln(l.options.Out, "findFuncUses")
-	defer fmt.Fprintln(l.options.Out, "findFuncUses done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -784,7 +1044,7 @@ func (l *libifier) findFuncUses() error {
 						}
 						lpIdent = lpi
 					}
-					if !lpIdent.funcObject[use] {
+					if !isPackageLevel(use) || !lpIdent.funcNames[use.Name()] {
 						return true
 					}
 					lp.funcUses[n] = true
@@ -797,8 +1057,6 @@ func (l *libifier) findFuncUses() error {
 }
 
 func (l *libifier) findAliasTypes() error {
-	fmt.Fprintln(l.options.Out, "findAliasTypes")
-	defer fmt.Fprintln(l.options.Out, "findAliasTypes done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -812,7 +1070,10 @@ func (l *libifier) findAliasTypes() error {
 						if _, ok := spec.Type.(*dst.StructType); ok {
 							continue
 						}
-						ob := lp.pkg.TypesInfo.Defs[lp.pkg.Decorator.Ast.Nodes[spec.Name].(*ast.Ident)]
+						ob := l.def(lp, spec.Name)
+						if ob == nil {
+							continue
+						}
 						lp.aliasTypeSpec[spec] = true
 						lp.aliasObject[ob] = true
 					}
@@ -825,8 +1086,6 @@ func (l *libifier) findAliasTypes() error {
 }
 
 func (l *libifier) findStructTypes() error {
-	fmt.Fprintln(l.options.Out, "findStructTypes")
-	defer fmt.Fprintln(l.options.Out, "findStructTypes done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -841,7 +1100,10 @@ func (l *libifier) findStructTypes() error {
 						if !ok {
 							continue
 						}
-						ob := lp.pkg.TypesInfo.Defs[lp.pkg.Decorator.Ast.Nodes[spec.Name].(*ast.Ident)]
+						ob := l.def(lp, spec.Name)
+						if ob == nil {
+							continue
+						}
 						lp.structStructType[st] = true
 						lp.structTypeSpec[spec] = true
 						lp.structObject[ob] = true
@@ -855,8 +1117,6 @@ func (l *libifier) findStructTypes() error {
 }
 
 func (l *libifier) findMethods() error {
-	fmt.Fprintln(l.options.Out, "findMethods")
-	defer fmt.Fprintln(l.options.Out, "findMethods done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
@@ -865,7 +1125,10 @@ func (l *libifier) findMethods() error {
 					if n.Recv == nil {
 						return true
 					}
-					ob := lp.pkg.TypesInfo.Defs[lp.pkg.Decorator.Ast.Nodes[n.Name].(*ast.Ident)]
+					ob := l.def(lp, n.Name)
+					if ob == nil {
+						return true
+					}
 					lp.methodObject[ob] = true
 					lp.methodFuncDecl[n] = true
 				}
@@ -877,18 +1140,26 @@ func (l *libifier) findMethods() error {
 }
 
 func (l *libifier) findFuncs() error {
-	fmt.Fprintln(l.options.Out, "findFuncs")
-	defer fmt.Fprintln(l.options.Out, "findFuncs done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
+			testFile := lp.isTestFile(file)
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
 				switch n := c.Node().(type) {
 				case *dst.FuncDecl:
 					if n.Recv != nil {
 						return true
 					}
-					ob := lp.pkg.TypesInfo.Defs[lp.pkg.Decorator.Ast.Nodes[n.Name].(*ast.Ident)]
+					ob := l.def(lp, n.Name)
+					if ob == nil {
+						return true
+					}
+					if testFile && isTestFunc(ob.(*types.Func)) {
+						// tests are called by the testing package so must keep their signature
+						lp.testFuncDecl[n] = true
+						return true
+					}
 					lp.funcObject[ob] = true
+					lp.funcNames[ob.Name()] = true
 					lp.funcFuncDecl[n] = true
 				}
 				return true
@@ -899,10 +1170,13 @@ func (l *libifier) findFuncs() error {
 }
 
 func (l *libifier) findPackageLevelVars() error {
-	fmt.Fprintln(l.options.Out, "findPackageLevelVars")
-	defer fmt.Fprintln(l.options.Out, "findPackageLevelVars done")
 	for _, lp := range l.packages {
 		for _, file := range lp.pkg.Syntax {
+			if lp.isTestFile(file) && !lp.test {
+				// vars in test files of a non-test package stay global: the PackageState type is
+				// in a non-test file so can't refer to types only declared in tests.
+				continue
+			}
 			dstutil.Apply(file, func(c *dstutil.Cursor) bool {
 				switch n := c.Node().(type) {
 				case *dst.GenDecl:
@@ -913,12 +1187,19 @@ func (l *libifier) findPackageLevelVars() error {
 						// skip vars inside functions
 						return true
 					}
-
-					lp.packageLevelVarGenDecl[n] = true
+					if hasEmbedDirective(n.Decs.Start) {
+						// go:embed vars must be package level so stay global
+						return true
+					}
 
 					for _, spec := range n.Specs {
 						spec := spec.(*dst.ValueSpec)
 
+						if hasEmbedDirective(spec.Decs.Start) {
+							continue
+						}
+
+						lp.packageLevelVarGenDecl[n] = true
 						lp.packageLevelVarValueSpec[spec] = true
 
 						// look up the object in the types.Defs
@@ -926,11 +1207,12 @@ func (l *libifier) findPackageLevelVars() error {
 							if id.Name == "_" {
 								continue
 							}
-							def, ok := lp.pkg.TypesInfo.Defs[lp.pkg.Decorator.Ast.Nodes[id].(*ast.Ident)]
-							if !ok {
-								panic(fmt.Sprintf("can't find %s in defs", id.Name))
+							def := l.def(lp, id)
+							if def == nil {
+								continue
 							}
 							lp.packageLevelVarObject[def] = true
+							lp.packageLevelVarNames[def.Name()] = true
 						}
 					}
 				}
@@ -942,19 +1224,22 @@ func (l *libifier) findPackageLevelVars() error {
 }
 
 func (l *libifier) load(ctx context.Context) error {
-	fmt.Fprintln(l.options.Out, "load")
-	defer fmt.Fprintln(l.options.Out, "load done")
+	defer l.progress().Phase("load")()
 
 	filter := func(p string) bool { return strings.HasPrefix(p, l.options.RootPath) }
 
 	start := time.Now()
 	var err error
-	l.paths, err = LoadAllPackages(ctx, l.options.Path, l.options.RootDir, l.options.Tests, filter)
+	l.paths, err = LoadPackages(ctx, LoadOptions{
+		Paths:  l.options.commands(),
+		Dir:    l.options.RootDir,
+		Tests:  l.options.Tests,
+		Filter: filter,
+	})
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	end := time.Now()
-	fmt.Fprintf(l.options.Out, "Loaded %d paths in %v seconds\n", len(l.paths), end.Sub(start).Seconds())
+	l.progress().Send(Event{Kind: PackagesLoaded, Phase: "load paths", Count: len(l.paths), Duration: time.Since(start)})
 
 	config := &packages.Config{
 		Mode:    packages.LoadSyntax,
@@ -970,8 +1255,7 @@ func (l *libifier) load(ctx context.Context) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	end = time.Now()
-	fmt.Fprintf(l.options.Out, "Loaded %d packages in %v seconds\n", len(l.paths), end.Sub(start).Seconds())
+	l.progress().Send(Event{Kind: PackagesLoaded, Phase: "load packages", Count: len(pkgs), Duration: time.Since(start)})
 
 	for _, pkg := range pkgs {
 
@@ -983,30 +1267,34 @@ func (l *libifier) load(ctx context.Context) error {
 		// | X_test  | X_test [X.test] | just test files in X_test package (this is missing if no X_test tests)
 		// | X.test  | X.test          | generated files
 		//
+		// Packages may also be loaded as recompiled variants for the tests of another package
+		// (e.g. "fmt [os.test]"). These contain no test files so are only used if nothing better
+		// is available.
+		testID := fmt.Sprintf("%s [%s.test]", pkg.PkgPath, pkg.PkgPath)
 		isTestPath := strings.HasSuffix(pkg.PkgPath, "_test")
-		isTestID := strings.HasSuffix(pkg.ID, ".test]")
+		isTestID := pkg.ID == testID
 		isTestGen := strings.HasSuffix(pkg.ID, ".test")
 
 		if isTestGen {
 			continue
 		}
 
-		pth := strings.TrimSuffix(pkg.PkgPath, "_test")
-		if l.packages[pth] == nil {
-			l.packages[pth] = newLibifyPkg(pth)
+		if l.packages[pkg.PkgPath] == nil {
+			l.packages[pkg.PkgPath] = newLibifyPkg(pkg.PkgPath)
 		}
-		p := l.packages[pth]
+		p := l.packages[pkg.PkgPath]
+		p.test = isTestPath
 
-		if isTestPath {
-			p.tst = pkg
-			continue
-		}
-
-		if isTestID {
+		switch {
+		case isTestID:
 			p.pkg = pkg
-		} else {
+		case pkg.ID == pkg.PkgPath:
 			// for non test id (e.g. id == "fmt"), only store if the variation with test files
 			// enabled (e.g. id == "fmt [fmt.test]") has not been stored yet.
+			if p.pkg == nil || p.pkg.ID != testID {
+				p.pkg = pkg
+			}
+		default:
 			if p.pkg == nil {
 				p.pkg = pkg
 			}
@@ -1017,11 +1305,81 @@ func (l *libifier) load(ctx context.Context) error {
 }
 
 type Options struct {
-	Path     string
+	Path string
+
+	// Paths are more commands to convert along with Path. The packages they share are converted
+	// once, and each command gets a Main.
+	Paths []string
+
 	RootPath string
 	RootDir  string
 	Out      io.Writer
 	Tests    bool
+
+	// Verbosity controls which progress events are printed to Out
+	Verbosity Verbosity
+
+	// Observer, if set, is called with every progress event
+	Observer func(Event)
+
+	// Library converts library packages rather than commands: main isn't renamed, and each package
+	// gets a NewInstance function that creates its package state and the states of all the packages
+	// it uses.
+	Library bool
+
+	// Shim is the path of a compatibility package to generate in library mode. It has the exported
+	// functions, types and consts of the package as it was before conversion, implemented with a
+	// default instance, so existing callers of those keep compiling. Exported vars become functions
+	// that return a pointer to the var in the default instance, so callers that use a var V must
+	// change to *V(). Anything that can't be shimmed (e.g. generic types, or functions that use
+	// unexported types of other packages) is left out with a warning. It must be inside the root
+	// path, and its last element must be a valid package name, or in method style it can be the
+	// converted package itself.
+	Shim string
+
+	// IsolationTests adds a libify_isolation_test.go file to each package, which checks that two
+	// package states don't share any state.
+	IsolationTests bool
+
+	// Style is how converted package level functions get the package state
+	Style Style
+}
+
+// Style is how converted package level functions get the package state
+type Style int
+
+const (
+	// ParamStyle adds the package state as the first parameter: func A(pstate *PackageState), called
+	// as A(pstate) or b.B(pstate.b).
+	ParamStyle Style = iota
+	// MethodStyle makes functions methods of the package state: func (pstate *PackageState) A(),
+	// called as pstate.A() or pstate.b.B(). Generic functions keep the parameter, because methods
+	// can't have type parameters.
+	MethodStyle
+)
+
+// commands returns Path and Paths, without duplicates
+func (o Options) commands() []string {
+	var out []string
+	done := map[string]bool{}
+	for _, path := range append([]string{o.Path}, o.Paths...) {
+		if path == "" || done[path] {
+			continue
+		}
+		done[path] = true
+		out = append(out, path)
+	}
+	return out
+}
+
+// hasEmbedDirective returns true if decs has a go:embed directive
+func hasEmbedDirective(decs dst.Decorations) bool {
+	for _, d := range decs {
+		if strings.HasPrefix(d, "//go:embed ") {
+			return true
+		}
+	}
+	return false
 }
 
 func stripVendor(path string) string {
@@ -1044,6 +1402,79 @@ func stripVendor(path string) string {
 	return path[i+len("vendor/"):]
 }
 
+// isTestFile returns true if file is a _test.go file
+func (lp *libifyPkg) isTestFile(file *dst.File) bool {
+	return strings.HasSuffix(lp.pkg.Decorator.Filenames[file], "_test.go")
+}
+
+// isPackageLevel returns true if ob is declared at package level. The same package may be loaded
+// in several variants (e.g. "fmt" and "fmt [fmt.test]"), so package level objects are matched by
+// name rather than by identity.
+func isPackageLevel(ob types.Object) bool {
+	return ob.Pkg() != nil && ob.Parent() == ob.Pkg().Scope()
+}
+
+// isTestFunc returns true if f is a test, benchmark, fuzz test, example or TestMain function that
+// will be called by the testing package.
+func isTestFunc(f *types.Func) bool {
+	sig := f.Type().(*types.Signature)
+	param := func(typ string) bool {
+		return sig.Params().Len() == 1 && sig.Results().Len() == 0 && types.TypeString(sig.Params().At(0).Type(), nil) == typ
+	}
+	name := f.Name()
+	switch {
+	case name == "TestMain":
+		return param("*testing.M")
+	case isTestName(name, "Test"):
+		return param("*testing.T")
+	case isTestName(name, "Benchmark"):
+		return param("*testing.B")
+	case isTestName(name, "Fuzz"):
+		return param("*testing.F")
+	case isTestName(name, "Example"):
+		return sig.Params().Len() == 0 && sig.Results().Len() == 0
+	}
+	return false
+}
+
+// isTestName returns true if name has the prefix, and is not followed by a lower case letter (e.g.
+// "Testing" is not a test name).
+func isTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// newFilename returns the path of a file called name to generate in the dir of lp. If the package
+// already has a file with that name (including files excluded by build constraints), a diagnostic
+// is added and false is returned.
+func (l *libifier) newFilename(lp *libifyPkg, name string) (string, bool) {
+	fpath := filepath.Join(lp.pkg.Dir, name)
+	exists := false
+	for _, fname := range lp.pkg.Decorator.Filenames {
+		if fname == fpath {
+			exists = true
+		}
+	}
+	if _, err := os.Stat(fpath); err == nil {
+		exists = true
+	}
+	if exists {
+		l.diagnostics = append(l.diagnostics, Diagnostic{
+			Pass:    l.pass,
+			Ident:   lp.pkg.PkgPath,
+			Message: fmt.Sprintf("can't generate %s because the package already has a file with that name", name),
+		})
+		return "", false
+	}
+	return fpath, true
+}
+
 type uniqueNamePicker map[string]bool
 
 // findAlias finds a unique alias given a path and a preferred alias
@@ -1065,47 +1496,57 @@ func (u uniqueNamePicker) pick(name string) string {
 	return current
 }
 
-func (l *libifier) typeToAstTypeSpec(t types.Type, path string) dst.Expr {
+// typeToAstTypeSpec returns a type expression for t, which will be used in the package with path.
+func (l *libifier) typeToAstTypeSpec(t types.Type, path string) (dst.Expr, error) {
 	switch t := t.(type) {
 	case *types.Basic:
 		switch t.Kind() {
 		case types.Bool, types.Int, types.Int8, types.Int16, types.Int32, types.Int64, types.Uint, types.Uint8, types.Uint16, types.Uint32, types.Uint64, types.Uintptr, types.Float32, types.Float64, types.Complex64, types.Complex128, types.String:
-			return dst.NewIdent(t.Name())
-		case types.UnsafePointer:
-			panic("TODO: types.UnsafePointer not implemented")
+			return dst.NewIdent(t.Name()), nil
 		case types.UntypedBool:
-			return dst.NewIdent("bool")
+			return dst.NewIdent("bool"), nil
 		case types.UntypedInt:
-			return dst.NewIdent("int")
+			return dst.NewIdent("int"), nil
 		case types.UntypedRune:
-			return dst.NewIdent("rune")
+			return dst.NewIdent("rune"), nil
 		case types.UntypedFloat:
-			return dst.NewIdent("float64")
+			return dst.NewIdent("float64"), nil
 		case types.UntypedComplex:
-			return dst.NewIdent("complex64")
+			return dst.NewIdent("complex64"), nil
 		case types.UntypedString:
-			return dst.NewIdent("string")
-		case types.UntypedNil:
-			panic("TODO: types.UntypedNil not implemented")
+			return dst.NewIdent("string"), nil
 		}
+		return nil, errors.Errorf("unsupported type %s", t)
 	case *types.Array:
+		elt, err := l.typeToAstTypeSpec(t.Elem(), path)
+		if err != nil {
+			return nil, err
+		}
 		return &dst.ArrayType{
 			Len: &dst.BasicLit{
 				Kind:  token.INT,
 				Value: fmt.Sprint(t.Len()),
 			},
-			Elt: l.typeToAstTypeSpec(t.Elem(), path),
-		}
+			Elt: elt,
+		}, nil
 	case *types.Slice:
-		return &dst.ArrayType{
-			Elt: l.typeToAstTypeSpec(t.Elem(), path),
+		elt, err := l.typeToAstTypeSpec(t.Elem(), path)
+		if err != nil {
+			return nil, err
 		}
+		return &dst.ArrayType{
+			Elt: elt,
+		}, nil
 	case *types.Struct:
 		var fields []*dst.Field
 		for i := 0; i < t.NumFields(); i++ {
+			typ, err := l.typeToAstTypeSpec(t.Field(i).Type(), path)
+			if err != nil {
+				return nil, err
+			}
 			f := &dst.Field{
 				Names: []*dst.Ident{dst.NewIdent(t.Field(i).Name())},
-				Type:  l.typeToAstTypeSpec(t.Field(i).Type(), path),
+				Type:  typ,
 			}
 			fields = append(fields, f)
 		}
@@ -1113,62 +1554,67 @@ func (l *libifier) typeToAstTypeSpec(t types.Type, path string) dst.Expr {
 			Fields: &dst.FieldList{
 				List: fields,
 			},
-		}
-
+		}, nil
 	case *types.Pointer:
-		return &dst.StarExpr{
-			X: l.typeToAstTypeSpec(t.Elem(), path),
+		x, err := l.typeToAstTypeSpec(t.Elem(), path)
+		if err != nil {
+			return nil, err
 		}
-	case *types.Tuple:
-		panic("tuple?")
+		return &dst.StarExpr{
+			X: x,
+		}, nil
 	case *types.Signature:
-		params := &dst.FieldList{}
-		for i := 0; i < t.Params().Len(); i++ {
-			f := &dst.Field{
-				Names: []*dst.Ident{dst.NewIdent(t.Params().At(i).Name())},
-				Type:  l.typeToAstTypeSpec(t.Params().At(i).Type(), path),
-			}
-			params.List = append(params.List, f)
+		params, err := l.tupleToFieldList(t.Params(), path)
+		if err != nil {
+			return nil, err
 		}
 		var results *dst.FieldList
 		if t.Results().Len() > 0 {
-			results = &dst.FieldList{}
-			for i := 0; i < t.Results().Len(); i++ {
-				f := &dst.Field{
-					Names: []*dst.Ident{dst.NewIdent(t.Results().At(i).Name())},
-					Type:  l.typeToAstTypeSpec(t.Results().At(i).Type(), path),
-				}
-				results.List = append(results.List, f)
+			results, err = l.tupleToFieldList(t.Results(), path)
+			if err != nil {
+				return nil, err
 			}
 		}
 		return &dst.FuncType{
 			Params:  params,
 			Results: results,
-		}
+		}, nil
 	case *types.Interface:
 		methods := &dst.FieldList{}
 		for i := 0; i < t.NumEmbeddeds(); i++ {
-			f := &dst.Field{
-				Type: l.typeToAstTypeSpec(t.Embedded(i), path),
+			typ, err := l.typeToAstTypeSpec(t.EmbeddedType(i), path)
+			if err != nil {
+				return nil, err
 			}
-			methods.List = append(methods.List, f)
+			methods.List = append(methods.List, &dst.Field{Type: typ})
 		}
 		for i := 0; i < t.NumExplicitMethods(); i++ {
+			typ, err := l.typeToAstTypeSpec(t.ExplicitMethod(i).Type(), path)
+			if err != nil {
+				return nil, err
+			}
 			f := &dst.Field{
 				Names: []*dst.Ident{dst.NewIdent(t.ExplicitMethod(i).Name())},
-				Type:  l.typeToAstTypeSpec(t.ExplicitMethod(i).Type(), path),
+				Type:  typ,
 			}
 			methods.List = append(methods.List, f)
 		}
-
 		return &dst.InterfaceType{
 			Methods: methods,
-		}
+		}, nil
 	case *types.Map:
-		return &dst.MapType{
-			Key:   l.typeToAstTypeSpec(t.Key(), path),
-			Value: l.typeToAstTypeSpec(t.Elem(), path),
+		key, err := l.typeToAstTypeSpec(t.Key(), path)
+		if err != nil {
+			return nil, err
 		}
+		value, err := l.typeToAstTypeSpec(t.Elem(), path)
+		if err != nil {
+			return nil, err
+		}
+		return &dst.MapType{
+			Key:   key,
+			Value: value,
+		}, nil
 	case *types.Chan:
 		var dir dst.ChanDir
 		switch t.Dir() {
@@ -1177,15 +1623,36 @@ func (l *libifier) typeToAstTypeSpec(t types.Type, path string) dst.Expr {
 		case types.RecvOnly:
 			dir = dst.RECV
 		}
+		value, err := l.typeToAstTypeSpec(t.Elem(), path)
+		if err != nil {
+			return nil, err
+		}
 		return &dst.ChanType{
 			Dir:   dir,
-			Value: l.typeToAstTypeSpec(t.Elem(), path),
-		}
+			Value: value,
+		}, nil
 	case *types.Named:
 		if t.Obj().Pkg() == nil || stripVendor(t.Obj().Pkg().Path()) == stripVendor(path) {
-			return &dst.Ident{Name: t.Obj().Name()}
+			return &dst.Ident{Name: t.Obj().Name()}, nil
+		}
+		return &dst.Ident{Name: t.Obj().Name(), Path: stripVendor(t.Obj().Pkg().Path())}, nil
+	}
+	return nil, errors.Errorf("unsupported type %s", t)
+}
+
+// tupleToFieldList returns a field list for the params or results of a signature
+func (l *libifier) tupleToFieldList(t *types.Tuple, path string) (*dst.FieldList, error) {
+	list := &dst.FieldList{}
+	for i := 0; i < t.Len(); i++ {
+		typ, err := l.typeToAstTypeSpec(t.At(i).Type(), path)
+		if err != nil {
+			return nil, err
+		}
+		f := &dst.Field{
+			Names: []*dst.Ident{dst.NewIdent(t.At(i).Name())},
+			Type:  typ,
 		}
-		return &dst.Ident{Name: t.Obj().Name(), Path: stripVendor(t.Obj().Pkg().Path())}
+		list.List = append(list.List, f)
 	}
-	panic(fmt.Sprintf("unsupported type %T", t))
+	return list, nil
 }
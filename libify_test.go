@@ -238,25 +238,7 @@ func TestFoo(t *testing.T) {
 
 func compareDir(t *testing.T, dir string, expect map[string]string) {
 	t.Helper()
-	found := map[string]string{}
-	walk := func(fpath string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-		relfpath, err := filepath.Rel(dir, fpath)
-		if err != nil {
-			t.Fatal(err)
-		}
-		b, err := ioutil.ReadFile(fpath)
-		if err != nil {
-			t.Fatal(err)
-		}
-		found[relfpath] = string(b)
-		return nil
-	}
-	if err := filepath.Walk(dir, walk); err != nil {
-		t.Fatal(err)
-	}
+	found := readDir(t, dir)
 	var keysFound []string
 	var keysExpect []string
 	for k := range found {
@@ -287,6 +269,30 @@ func compareDir(t *testing.T, dir string, expect map[string]string) {
 	}
 }
 
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	found := map[string]string{}
+	walk := func(fpath string, info os.FileInfo, err error) error {
+		if info.IsDir() {
+			return nil
+		}
+		relfpath, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found[filepath.ToSlash(relfpath)] = string(b)
+		return nil
+	}
+	if err := filepath.Walk(dir, walk); err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
 func TestMain_load(t *testing.T) {
 	dir, err := TempDir(map[string]string{
 		"main/main.go": "package main \n\n import \"root/a\" \n\n func main(){a.A()}",
@@ -372,3 +378,15 @@ func compareSrc(t *testing.T, expect, found string) {
 		t.Errorf("\nexpect: %q\nfound : %q", expect, found)
 	}
 }
+
+func TestMain_runPassesPanic(t *testing.T) {
+	l := libifier{options: Options{Out: ioutil.Discard}}
+	err := l.runPasses(pass{"boom", func() error { panic("boom") }})
+	d, ok := err.(Diagnostics)
+	if !ok || len(d) != 1 {
+		t.Fatalf("expected 1 diagnostic, got %v", err)
+	}
+	if d[0].Pass != "boom" || !strings.HasPrefix(d[0].Message, "panic: boom\n") || !strings.Contains(d[0].Message, "TestMain_runPassesPanic") {
+		t.Errorf("expected the panic and its stack, got %q", d[0].Message)
+	}
+}
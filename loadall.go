@@ -8,15 +8,42 @@ import (
 	"golang.org/x/tools/go/packages"
 )
 
+// LoadOptions are the options for LoadPackages
+type LoadOptions struct {
+	Paths  []string          // package paths to load
+	Dir    string            // dir to load from
+	Env    []string          // environment of the go command (default the current environment)
+	Tests  bool              // also load the test packages of the loaded packages
+	Filter func(string) bool // packages that don't pass are left out, with their imports (default all packages pass)
+}
+
+// LoadAllPackages returns the paths of the package path and all the packages it imports (directly
+// or indirectly) that pass filter. It's LoadPackages for a single package path.
 func LoadAllPackages(ctx context.Context, path, dir string, tests bool, filter func(string) bool) ([]string, error) {
+	return LoadPackages(ctx, LoadOptions{Paths: []string{path}, Dir: dir, Tests: tests, Filter: filter})
+}
+
+// LoadPackages returns the paths of the packages in options.Paths and all the packages they import
+// (directly or indirectly) that pass options.Filter. Packages shared by several paths are only
+// returned once.
+func LoadPackages(ctx context.Context, options LoadOptions) ([]string, error) {
+	paths, tests, filter := options.Paths, options.Tests, options.Filter
+	if filter == nil {
+		filter = func(string) bool { return true }
+	}
 	cfg := &packages.Config{
 		Mode:    packages.LoadImports,
 		Tests:   tests,
 		Context: ctx,
-		Dir:     dir,
+		Dir:     options.Dir,
+		Env:     options.Env,
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("no package paths to load")
 	}
 
-	pkgs, err := packages.Load(cfg, path)
+	pkgs, err := packages.Load(cfg, paths...)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
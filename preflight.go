@@ -0,0 +1,334 @@
+package libify
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Severity is the severity of a preflight finding
+type Severity int
+
+const (
+	// Warning means libify can convert the construct, but the output may not behave the same
+	Warning Severity = iota
+	// Error means libify can't convert the construct
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Finding is a construct found by the preflight checker that libify can't convert, or that may not
+// behave the same after conversion.
+type Finding struct {
+	Pos      token.Position
+	Severity Severity
+	Message  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Pos, f.Severity, f.Message)
+}
+
+// Preflight loads the packages and scans them for constructs that libify can't convert, without
+// making any changes.
+func Preflight(ctx context.Context, options Options) ([]Finding, error) {
+	if options.Out == nil {
+		options.Out = os.Stdout
+	}
+	l := &libifier{options: options}
+	if err := l.load(ctx); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer l.progress().Phase("preflight")()
+	if err := l.preflight(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l.findings, nil
+}
+
+func (l *libifier) preflight() error {
+	for _, lp := range l.packages {
+		for _, file := range lp.pkg.Package.Syntax {
+			l.preflightDirectives(lp, file)
+			l.preflightExprs(lp, file)
+		}
+		if err := l.preflightCgo(lp); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := l.preflightAssembly(lp); err != nil {
+			return errors.WithStack(err)
+		}
+		l.preflightVarTypes(lp)
+		l.preflightTestVars(lp)
+	}
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		pi, pj := l.findings[i].Pos, l.findings[j].Pos
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Column < pj.Column
+	})
+	return nil
+}
+
+// reportFindings sends an event for each preflight finding with Warning severity, and adds a diagnostic for each
+// finding with Error severity.
+func (l *libifier) reportFindings() error {
+	for _, f := range l.findings {
+		if f.Severity == Error {
+			l.diagnostics = append(l.diagnostics, Diagnostic{
+				Pos:     f.Pos,
+				Pass:    l.pass,
+				Message: f.Message,
+			})
+			continue
+		}
+		l.progress().Send(Event{Kind: WarningFound, Pos: f.Pos, Message: f.Message})
+	}
+	return nil
+}
+
+func (l *libifier) addFinding(lp *libifyPkg, pos token.Pos, severity Severity, format string, args ...interface{}) {
+	l.findings = append(l.findings, Finding{
+		Pos:      lp.pkg.Fset.Position(pos),
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// inScopeObject returns true if ob is a package level var or func in a package that will be
+// converted.
+func (l *libifier) inScopeObject(ob types.Object) bool {
+	switch ob.(type) {
+	case *types.Var, *types.Func:
+	default:
+		return false
+	}
+	if !isPackageLevel(ob) {
+		return false
+	}
+	_, ok := l.packages[ob.Pkg().Path()]
+	return ok
+}
+
+// preflightDirectives finds go:linkname and go:embed directives
+func (l *libifier) preflightDirectives(lp *libifyPkg, file *ast.File) {
+	for _, cg := range file.Comments {
+		for _, c := range cg.List {
+			switch {
+			case strings.HasPrefix(c.Text, "//go:linkname "):
+				fields := strings.Fields(c.Text)
+				if len(fields) < 2 {
+					continue
+				}
+				if ob := lp.pkg.Types.Scope().Lookup(fields[1]); ob != nil && l.inScopeObject(ob) {
+					l.addFinding(lp, c.Pos(), Error, "go:linkname refers to %s, which will be moved into PackageState or gain a pstate parameter", fields[1])
+					continue
+				}
+				l.addFinding(lp, c.Pos(), Warning, "go:linkname %s may refer to a symbol that libify changes", strings.Join(fields[1:], " "))
+			case strings.HasPrefix(c.Text, "//go:embed "):
+				l.addFinding(lp, c.Pos(), Warning, "go:embed vars must be package level so stay global and are shared between instances")
+			}
+		}
+	}
+}
+
+// preflightCgo finds cgo files. These are replaced by preprocessed files in Syntax, so the original
+// files are parsed.
+func (l *libifier) preflightCgo(lp *libifyPkg) error {
+	fset := token.NewFileSet()
+	for _, fpath := range lp.pkg.GoFiles {
+		file, err := parser.ParseFile(fset, fpath, nil, parser.ImportsOnly)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, imp := range file.Imports {
+			if imp.Path.Value == `"C"` {
+				l.findings = append(l.findings, Finding{
+					Pos:      fset.Position(imp.Pos()),
+					Severity: Error,
+					Message:  "cgo is not supported",
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// preflightExprs finds reflection on package level vars and funcs, and unsafe layout functions on
+// types that gain a pstate field.
+func (l *libifier) preflightExprs(lp *libifyPkg, file *ast.File) {
+	info := lp.pkg.TypesInfo
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		var fun *ast.Ident
+		switch f := call.Fun.(type) {
+		case *ast.Ident:
+			fun = f
+		case *ast.SelectorExpr:
+			fun = f.Sel
+		default:
+			return true
+		}
+		ob := info.Uses[fun]
+		if ob == nil || ob.Pkg() == nil {
+			return true
+		}
+		switch ob.Pkg().Path() {
+		case "reflect":
+			for _, arg := range call.Args {
+				ast.Inspect(arg, func(n ast.Node) bool {
+					id, ok := n.(*ast.Ident)
+					if !ok {
+						return true
+					}
+					if use := info.Uses[id]; use != nil && l.inScopeObject(use) {
+						l.addFinding(lp, id.Pos(), Warning, "reflection on %s may behave differently after it is converted", id.Name)
+					}
+					return true
+				})
+			}
+		case "unsafe":
+			switch ob.Name() {
+			case "Sizeof", "Alignof", "Offsetof":
+			default:
+				return true
+			}
+			for _, arg := range call.Args {
+				if named, ok := info.TypeOf(arg).(*types.Named); ok && named.Obj().Pkg() != nil {
+					if _, ok := l.packages[named.Obj().Pkg().Path()]; ok {
+						l.addFinding(lp, call.Pos(), Warning, "unsafe.%s of %s will change when it gains a pstate field", ob.Name(), named.Obj().Name())
+					}
+				}
+			}
+		}
+		return true
+	})
+}
+
+// preflightAssembly finds assembly files that refer to package level vars or funcs
+func (l *libifier) preflightAssembly(lp *libifyPkg) error {
+	for _, fpath := range lp.pkg.OtherFiles {
+		if !strings.HasSuffix(fpath, ".s") {
+			continue
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		scanner := bufio.NewScanner(f)
+		var line int
+		for scanner.Scan() {
+			line++
+			text := scanner.Text()
+			for {
+				i := strings.Index(text, "·")
+				if i == -1 {
+					break
+				}
+				text = text[i+len("·"):]
+				end := strings.IndexFunc(text, func(r rune) bool {
+					return !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+				})
+				if end == -1 {
+					end = len(text)
+				}
+				name := text[:end]
+				if ob := lp.pkg.Types.Scope().Lookup(name); ob != nil && l.inScopeObject(ob) {
+					l.findings = append(l.findings, Finding{
+						Pos:      token.Position{Filename: fpath, Line: line},
+						Severity: Error,
+						Message:  fmt.Sprintf("assembly refers to %s, which will be moved into PackageState or gain a pstate parameter", name),
+					})
+				}
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// preflightVarTypes finds package level vars with types that can't be converted
+func (l *libifier) preflightVarTypes(lp *libifyPkg) {
+	scope := lp.pkg.Types.Scope()
+	for _, name := range scope.Names() {
+		v, ok := scope.Lookup(name).(*types.Var)
+		if !ok {
+			continue
+		}
+		if b, ok := v.Type().(*types.Basic); ok && b.Kind() == types.UnsafePointer {
+			l.addFinding(lp, v.Pos(), Error, "package level var %s of type unsafe.Pointer is not supported", name)
+		}
+	}
+}
+
+// preflightTestVars finds package level vars in the test files of a non-test package with
+// initializers that use converted vars or funcs. These vars stay global (see findPackageLevelVars),
+// so there's no package state to get the converted vars and funcs from.
+func (l *libifier) preflightTestVars(lp *libifyPkg) {
+	if lp.test {
+		return
+	}
+	info := lp.pkg.TypesInfo
+	testFile := func(pos token.Pos) bool {
+		return strings.HasSuffix(lp.pkg.Fset.Position(pos).Filename, "_test.go")
+	}
+	for _, file := range lp.pkg.Package.Syntax {
+		if !testFile(file.Pos()) {
+			continue
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				for _, value := range spec.(*ast.ValueSpec).Values {
+					ast.Inspect(value, func(n ast.Node) bool {
+						id, ok := n.(*ast.Ident)
+						if !ok {
+							return true
+						}
+						use := info.Uses[id]
+						if use == nil || !l.inScopeObject(use) {
+							return true
+						}
+						if _, ok := use.(*types.Var); ok && testFile(use.Pos()) {
+							// vars in test files stay global too
+							return true
+						}
+						l.addFinding(lp, id.Pos(), Error, "package level vars in test files stay global, so can't use %s, which will be moved into PackageState or gain a pstate parameter", id.Name)
+						return true
+					})
+				}
+			}
+		}
+	}
+}
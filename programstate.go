@@ -0,0 +1,167 @@
+package libify
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+	"unicode"
+
+	"github.com/dave/dst"
+)
+
+// programState is the generated ProgramState type of a command or library package
+type programState struct {
+	typeName, funcName string
+	fields             map[*libifyPkg]string // package -> field name
+}
+
+// addProgramStates adds a program-state.go file to each command (each library package in library
+// mode). It has a ProgramState type with a field for the package state of every in-scope package
+// the program uses, and a NewProgramState function that creates each of them exactly once, in
+// dependency order. Fields that are set in the preset passed to NewProgramState are used instead
+// of creating a new state, so the state of any package can be substituted.
+func (l *libifier) addProgramStates() error {
+	for _, path := range l.options.commands() {
+		lp, ok := l.packages[path]
+		if !ok || (!l.options.Library && lp.pkg.Name != "main") {
+			// missing packages are reported by renameMain or addInstanceFuncs
+			continue
+		}
+
+		u := uniqueNamePicker{}
+		for _, name := range lp.pkg.Types.Scope().Names() {
+			u[name] = true
+		}
+		ps := &programState{
+			typeName: u.pick("ProgramState"),
+			funcName: u.pick("NewProgramState"),
+			fields:   map[*libifyPkg]string{},
+		}
+		lp.programState = ps
+
+		graph := l.sortStateGraph(lp)
+		fieldNames := uniqueNamePicker{}
+		var fields []*dst.Field
+		for _, p := range graph {
+			ps.fields[p] = fieldNames.pick(l.programStateFieldName(p))
+			typ := &dst.Ident{Name: "PackageState"}
+			if p != lp {
+				typ.Path = p.pathNoVendor
+			}
+			fields = append(fields, &dst.Field{
+				Names: []*dst.Ident{dst.NewIdent(ps.fields[p])},
+				Type:  &dst.StarExpr{X: typ},
+			})
+		}
+
+		typeDecl := &dst.GenDecl{
+			Tok: token.TYPE,
+			Specs: []dst.Spec{&dst.TypeSpec{
+				Name: dst.NewIdent(ps.typeName),
+				Type: &dst.StructType{Fields: &dst.FieldList{List: fields}},
+			}},
+		}
+		typeDecl.Decs.Before = dst.EmptyLine
+		typeDecl.Decs.Start.Append(fmt.Sprintf("// %s has the package state of every package the program uses, in dependency order.", ps.typeName))
+
+		// state := &ProgramState{}
+		// if preset != nil {
+		// 	*state = *preset
+		// }
+		body := []dst.Stmt{
+			&dst.AssignStmt{
+				Lhs: []dst.Expr{dst.NewIdent("state")},
+				Tok: token.DEFINE,
+				Rhs: []dst.Expr{&dst.UnaryExpr{Op: token.AND, X: &dst.CompositeLit{Type: dst.NewIdent(ps.typeName)}}},
+			},
+			&dst.IfStmt{
+				Cond: &dst.BinaryExpr{X: dst.NewIdent("preset"), Op: token.NEQ, Y: dst.NewIdent("nil")},
+				Body: &dst.BlockStmt{List: []dst.Stmt{&dst.AssignStmt{
+					Lhs: []dst.Expr{&dst.StarExpr{X: dst.NewIdent("state")}},
+					Tok: token.ASSIGN,
+					Rhs: []dst.Expr{&dst.StarExpr{X: dst.NewIdent("preset")}},
+				}}},
+			},
+		}
+		field := func(p *libifyPkg) dst.Expr {
+			return &dst.SelectorExpr{X: dst.NewIdent("state"), Sel: dst.NewIdent(ps.fields[p])}
+		}
+		// if state.A == nil {
+		// 	state.A = a.NewPackageState(...)
+		// }
+		for _, p := range graph {
+			var args []dst.Expr
+			for _, imp := range l.sortAndFilterImports(p) {
+				args = append(args, field(imp))
+			}
+			fun := &dst.Ident{Name: "NewPackageState"}
+			if p != lp {
+				fun.Path = p.pathNoVendor
+			}
+			body = append(body, &dst.IfStmt{
+				Cond: &dst.BinaryExpr{X: field(p), Op: token.EQL, Y: dst.NewIdent("nil")},
+				Body: &dst.BlockStmt{List: []dst.Stmt{&dst.AssignStmt{
+					Lhs: []dst.Expr{field(p)},
+					Tok: token.ASSIGN,
+					Rhs: []dst.Expr{&dst.CallExpr{Fun: fun, Args: args}},
+				}}},
+			})
+		}
+		body = append(body, &dst.ReturnStmt{Results: []dst.Expr{dst.NewIdent("state")}})
+
+		funcDecl := &dst.FuncDecl{
+			Name: dst.NewIdent(ps.funcName),
+			Type: &dst.FuncType{
+				Params: &dst.FieldList{List: []*dst.Field{{
+					Names: []*dst.Ident{dst.NewIdent("preset")},
+					Type:  &dst.StarExpr{X: dst.NewIdent(ps.typeName)},
+				}}},
+				Results: &dst.FieldList{List: []*dst.Field{{Type: &dst.StarExpr{X: dst.NewIdent(ps.typeName)}}}},
+			},
+			Body: &dst.BlockStmt{List: body},
+		}
+		funcDecl.Decs.Before = dst.EmptyLine
+		funcDecl.Decs.Start.Append(fmt.Sprintf("// %s creates the package state of every package the program uses, each exactly once and", ps.funcName))
+		funcDecl.Decs.Start.Append("// in dependency order. If preset is not nil, its non-nil fields are used instead of creating new")
+		funcDecl.Decs.Start.Append("// package states.")
+
+		fpath, ok := l.newFilename(lp, "program-state.go")
+		if !ok {
+			continue
+		}
+		f := &dst.File{
+			Name:  dst.NewIdent(lp.pkg.Name),
+			Decls: []dst.Decl{typeDecl, funcDecl},
+		}
+		lp.pkg.Syntax = append(lp.pkg.Syntax, f)
+		lp.pkg.Decorator.Filenames[f] = fpath
+	}
+	return nil
+}
+
+// programStateFieldName returns the exported field name for the package state of p in
+// ProgramState, from the path of p relative to the root (e.g. "cmd/internal/obj" ->
+// "CmdInternalObj").
+func (l *libifier) programStateFieldName(p *libifyPkg) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(p.pathNoVendor, l.options.RootPath), "/")
+	if rel == "" {
+		rel = p.pkg.Name
+	}
+	var name []rune
+	upper := true
+	for _, r := range rel {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		name = append(name, r)
+	}
+	if len(name) == 0 || !unicode.IsLetter(name[0]) {
+		name = append([]rune("P"), name...)
+	}
+	return string(name)
+}
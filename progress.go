@@ -0,0 +1,119 @@
+package libify
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"time"
+)
+
+// EventKind is the kind of a progress event
+type EventKind int
+
+const (
+	// PhaseStarted is sent when a phase (load, a pass, save etc.) starts
+	PhaseStarted EventKind = iota
+	// PhaseFinished is sent when a phase finishes. Duration is set.
+	PhaseFinished
+	// PackagesLoaded is sent after packages are loaded. Count and Duration are set.
+	PackagesLoaded
+	// PackageCounts is sent for each package after the find passes. Package and Counts are set.
+	PackageCounts
+	// WarningFound is sent for constructs that are converted but may not behave the same. Pos (if known)
+	// and Message are set.
+	WarningFound
+)
+
+// Event is a progress event sent to Options.Observer
+type Event struct {
+	Kind     EventKind
+	Phase    string
+	Duration time.Duration
+	Count    int
+	Package  string
+	Counts   Counts
+	Pos      token.Position
+	Message  string
+}
+
+// Counts is the number of declarations and uses in a package that will be converted
+type Counts struct {
+	Vars, Funcs, Methods, Structs, Aliases, VarUses, FuncUses int
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case PhaseStarted:
+		return e.Phase
+	case PhaseFinished:
+		return fmt.Sprintf("%s done in %v", e.Phase, e.Duration)
+	case PackagesLoaded:
+		return fmt.Sprintf("%s: loaded %d packages in %v", e.Phase, e.Count, e.Duration)
+	case PackageCounts:
+		c := e.Counts
+		return fmt.Sprintf("%s: %d vars, %d funcs, %d methods, %d structs, %d aliases, %d var uses, %d func uses", e.Package, c.Vars, c.Funcs, c.Methods, c.Structs, c.Aliases, c.VarUses, c.FuncUses)
+	case WarningFound:
+		if e.Pos.IsValid() {
+			return fmt.Sprintf("%s: warning: %s", e.Pos, e.Message)
+		}
+		return fmt.Sprintf("warning: %s", e.Message)
+	}
+	return fmt.Sprintf("EventKind(%d)", int(e.Kind))
+}
+
+// Verbosity controls which events are printed to Options.Out. The Observer gets all events
+// regardless. The zero value is Normal, and higher values print more.
+type Verbosity int
+
+const (
+	// Silent prints nothing
+	Silent Verbosity = -2
+	// Quiet prints only warnings
+	Quiet Verbosity = -1
+	// Normal prints phases, load timings and warnings
+	Normal Verbosity = 0
+	// Verbose prints everything, including per-package counts
+	Verbose Verbosity = 1
+)
+
+func (v Verbosity) prints(kind EventKind) bool {
+	switch {
+	case v <= Silent:
+		return false
+	case v == Quiet:
+		return kind == WarningFound
+	case v >= Verbose:
+		return true
+	}
+	return kind != PackageCounts
+}
+
+// Progress prints events to Out according to Verbosity, and sends every event to Observer. The zero
+// value discards everything.
+type Progress struct {
+	Out       io.Writer
+	Verbosity Verbosity
+	Observer  func(Event)
+}
+
+// Send sends an event
+func (p Progress) Send(e Event) {
+	if p.Observer != nil {
+		p.Observer(e)
+	}
+	if p.Out != nil && p.Verbosity.prints(e.Kind) {
+		fmt.Fprintln(p.Out, e)
+	}
+}
+
+// Phase sends a PhaseStarted event, and returns a function that sends the PhaseFinished event. Use
+// with defer:
+//
+//	defer p.Phase("load")()
+func (p Progress) Phase(name string) func() {
+	start := time.Now()
+	p.Send(Event{Kind: PhaseStarted, Phase: name})
+	return func() {
+		p.Send(Event{Kind: PhaseFinished, Phase: name, Duration: time.Since(start)})
+	}
+}
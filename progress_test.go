@@ -0,0 +1,95 @@
+package libify
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	src := map[string]string{
+		"go.mod":   "module root\n\ngo 1.16",
+		"a/a.go":   "package a\n\nvar i int\n\nfunc A() { i++ }",
+		"cmd/m.go": "package main\n\nimport \"root/a\"\n\nfunc main() { a.A() }",
+	}
+	for _, v := range []Verbosity{Silent, Quiet, Normal, Verbose} {
+		dir, err := TempDir(src)
+		defer os.RemoveAll(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		started := map[string]int{}
+		finished := map[string]int{}
+		counts := map[string]Counts{}
+		options := Options{
+			Path:      "root/cmd",
+			RootPath:  "root",
+			RootDir:   dir,
+			Out:       out,
+			Verbosity: v,
+			Observer: func(e Event) {
+				switch e.Kind {
+				case PhaseStarted:
+					started[e.Phase]++
+				case PhaseFinished:
+					finished[e.Phase]++
+				case PackageCounts:
+					counts[e.Package] = e.Counts
+				}
+			},
+		}
+		if err := Main(context.Background(), options); err != nil {
+			t.Fatal(err)
+		}
+
+		// the observer gets every event regardless of verbosity
+		for _, phase := range []string{"load", "preflight", "findUses", "updateUses", "save"} {
+			if started[phase] != 1 || finished[phase] != 1 {
+				t.Errorf("verbosity %d: phase %s started %d times, finished %d times", v, phase, started[phase], finished[phase])
+			}
+		}
+		if c := counts["root/a"]; c.Vars != 1 || c.Funcs != 1 || c.VarUses != 1 {
+			t.Errorf("verbosity %d: unexpected counts for root/a: %+v", v, c)
+		}
+
+		printed := out.String()
+		hasPhases := strings.Contains(printed, "findUses done in")
+		hasCounts := strings.Contains(printed, "root/a: 1 vars, 1 funcs")
+		switch v {
+		case Silent, Quiet:
+			if printed != "" {
+				t.Errorf("verbosity %d: unexpected output %q", v, printed)
+			}
+		case Normal:
+			if !hasPhases || hasCounts {
+				t.Errorf("verbosity %d: unexpected output %q", v, printed)
+			}
+		case Verbose:
+			if !hasPhases || !hasCounts {
+				t.Errorf("verbosity %d: unexpected output %q", v, printed)
+			}
+		}
+	}
+}
+
+func TestVerbosityOrder(t *testing.T) {
+	// each verbosity prints everything the lower ones print
+	levels := []Verbosity{Silent, Quiet, Normal, Verbose}
+	for i := 1; i < len(levels); i++ {
+		lower, higher := levels[i-1], levels[i]
+		if lower >= higher {
+			t.Errorf("expected verbosity %d < %d", lower, higher)
+		}
+		for kind := PhaseStarted; kind <= WarningFound; kind++ {
+			if lower.prints(kind) && !higher.prints(kind) {
+				t.Errorf("verbosity %d prints event kind %d but %d doesn't", lower, kind, higher)
+			}
+		}
+	}
+	if Verbosity(0) != Normal {
+		t.Errorf("expected the zero value to be Normal")
+	}
+}
@@ -0,0 +1,396 @@
+package libify
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/pkg/errors"
+)
+
+// shimFilename is the file the shim is generated in. It's prefixed so it doesn't replace a file of
+// the package when the shim is the converted package or an existing dir.
+const shimFilename = "libify-shim.go"
+
+// shimDefaultFunc is the name of the func that returns the default instance of the shim. The name
+// is fixed because callers use it to get the state the shim uses (e.g. to pass to code that takes
+// the package state), so if the package already has something with the name, addShim fails.
+const shimDefaultFunc = "DefaultInstance"
+
+// shim is a generated compatibility package
+type shim struct {
+	path  string
+	fpath string
+	file  *dst.File
+}
+
+// validateShim checks the Shim option can be used with the other options
+func (o Options) validateShim() error {
+	if o.Shim == "" {
+		return nil
+	}
+	commands := o.commands()
+	switch {
+	case !o.Library:
+		return errors.New("shim needs library mode")
+	case len(commands) != 1:
+		return errors.New("shim needs exactly one library package")
+	case o.Shim == commands[0] && o.Style != MethodStyle:
+		return errors.Errorf("shim %s can only be the converted package in method style: the original names are taken by the converted functions", o.Shim)
+	case !strings.HasPrefix(o.Shim, o.RootPath+"/"):
+		return errors.Errorf("shim %s must be inside the root path %s", o.Shim, o.RootPath)
+	case o.Shim != commands[0] && !token.IsIdentifier(path.Base(o.Shim)):
+		return errors.Errorf("shim %s must end in a valid package name, because the package is named after it", o.Shim)
+	}
+	return nil
+}
+
+// addShim generates the compatibility package, which has the exported API of the library package
+// as it was before conversion. Functions are implemented by delegating to a default instance,
+// which is created the first time it's needed, and returned by DefaultInstance. Types and consts are
+// aliases. Exported vars can't be shimmed without changing how they're used (a copy would not see or
+// make changes to the default instance), so each var becomes a function that returns a pointer to
+// the field of the default instance, and callers change from V to *V(). In method style the shim can be the library package itself, so the
+// functions are added next to the methods they call, and types and consts are left alone.
+func (l *libifier) addShim() error {
+	lp, ok := l.packages[l.options.commands()[0]]
+	if !ok {
+		// reported by addInstanceFuncs
+		return nil
+	}
+	same := l.options.Shim == lp.path
+
+	var fpath string
+	var fileOK bool
+	if same {
+		fpath, fileOK = l.newFilename(lp, shimFilename)
+	} else {
+		dir := filepath.Join(l.options.RootDir, filepath.FromSlash(strings.TrimPrefix(l.options.Shim, l.options.RootPath+"/")))
+		fpath = filepath.Join(dir, shimFilename)
+		if _, err := os.Stat(fpath); err != nil {
+			fileOK = true
+		} else {
+			l.diagnostics = append(l.diagnostics, Diagnostic{
+				Pass:    l.pass,
+				Ident:   l.options.Shim,
+				Message: fmt.Sprintf("can't generate %s because the shim dir already has a file with that name", shimFilename),
+			})
+		}
+	}
+
+	u := uniqueNamePicker{}
+	if same {
+		// the shim shares a namespace with everything in the package, including generated names
+		for _, name := range lp.pkg.Types.Scope().Names() {
+			u[name] = true
+		}
+		for _, name := range []string{"PackageState", "NewPackageState", lp.instanceFunc, lp.programState.typeName, lp.programState.funcName} {
+			u[name] = true
+		}
+	}
+	aliased := map[string]bool{} // exported types that the shim aliases
+	var objects []types.Object
+	for _, name := range lp.pkg.Types.Scope().Names() {
+		ob := lp.pkg.Types.Scope().Lookup(name)
+		if !ob.Exported() || strings.HasSuffix(lp.pkg.Fset.Position(ob.Pos()).Filename, "_test.go") {
+			continue
+		}
+		u[name] = true
+		objects = append(objects, ob)
+		if named, ok := ob.Type().(*types.Named); ok && named.TypeParams().Len() == 0 {
+			if _, ok := ob.(*types.TypeName); ok {
+				aliased[name] = true
+			}
+		}
+	}
+	if u[shimDefaultFunc] {
+		l.diagnostics = append(l.diagnostics, Diagnostic{
+			Pass:    l.pass,
+			Ident:   shimDefaultFunc,
+			Message: fmt.Sprintf("shim %s needs %s for the default instance, but the package already has it", l.options.Shim, shimDefaultFunc),
+		})
+		return nil
+	}
+	if !fileOK {
+		return nil
+	}
+	defaultFunc := shimDefaultFunc
+	onceVar := u.pick("defaultOnce")
+	stateVar := u.pick("defaultState")
+
+	state := &dst.StarExpr{X: &dst.Ident{Name: "PackageState", Path: lp.pathNoVendor}}
+	callDefault := func() dst.Expr { return &dst.CallExpr{Fun: dst.NewIdent(defaultFunc)} }
+
+	warn := func(ob types.Object, reason string) {
+		l.progress().Send(Event{
+			Kind:    WarningFound,
+			Package: lp.path,
+			Pos:     lp.pkg.Fset.Position(ob.Pos()),
+			Message: fmt.Sprintf("%s isn't in shim %s: %s", ob.Name(), l.options.Shim, reason),
+		})
+	}
+
+	// typeExpr returns a type expression for t in the shim, and false if t refers to unexported
+	// types of another package. Types of the library package refer to the aliases in the shim.
+	typeExpr := func(t types.Type) (dst.Expr, bool) {
+		expr, err := l.typeToAstTypeSpec(t, l.options.Shim)
+		if err != nil {
+			return nil, false
+		}
+		exported := true
+		dst.Inspect(expr, func(n dst.Node) bool {
+			id, ok := n.(*dst.Ident)
+			if !ok || id.Path == "" {
+				return true
+			}
+			if !token.IsExported(id.Name) {
+				exported = false
+			}
+			if id.Path == lp.pathNoVendor && aliased[id.Name] {
+				id.Path = ""
+			}
+			return true
+		})
+		return expr, exported
+	}
+
+	var constSpecs, typeSpecs []dst.Spec
+	var funcs []dst.Decl
+	for _, ob := range objects {
+		switch ob.(type) {
+		case *types.Const, *types.TypeName:
+			if same {
+				continue
+			}
+		}
+		switch ob := ob.(type) {
+		case *types.Const:
+			constSpecs = append(constSpecs, &dst.ValueSpec{
+				Names:  []*dst.Ident{dst.NewIdent(ob.Name())},
+				Values: []dst.Expr{&dst.Ident{Name: ob.Name(), Path: lp.pathNoVendor}},
+			})
+		case *types.Var:
+			if !lp.packageLevelVarObject[ob] {
+				continue
+			}
+			decl, reason := l.generateShimVarFunc(lp, ob, typeExpr, callDefault)
+			if decl == nil {
+				warn(ob, reason)
+				continue
+			}
+			funcs = append(funcs, decl)
+		case *types.TypeName:
+			if named, ok := ob.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+				warn(ob, "generic types can't be aliased")
+				continue
+			}
+			typeSpecs = append(typeSpecs, &dst.TypeSpec{
+				Name:   dst.NewIdent(ob.Name()),
+				Assign: true,
+				Type:   &dst.Ident{Name: ob.Name(), Path: lp.pathNoVendor},
+			})
+		case *types.Func:
+			if !lp.funcObject[ob] {
+				continue
+			}
+			decl, reason := l.generateShimFunc(lp, ob, typeExpr, callDefault)
+			if decl == nil {
+				warn(ob, reason)
+				continue
+			}
+			funcs = append(funcs, decl)
+		}
+	}
+
+	f := &dst.File{Name: dst.NewIdent(path.Base(l.options.Shim))}
+	if same {
+		f.Name.Name = lp.pkg.Name
+	} else {
+		f.Decs.Start.Append(fmt.Sprintf("// Package %s is a compatibility layer for %s, generated by libify. It has the", f.Name.Name, lp.pathNoVendor))
+		f.Decs.Start.Append("// exported API of the package before it was converted, implemented with a default instance.")
+		f.Decs.Start.Append("// Exported vars are functions that return a pointer to the var in the default instance.")
+	}
+
+	block := func(tok token.Token, specs []dst.Spec, comment ...string) {
+		if len(specs) == 0 {
+			return
+		}
+		decl := &dst.GenDecl{Tok: tok, Specs: specs, Lparen: true}
+		decl.Decs.Before = dst.EmptyLine
+		for _, c := range comment {
+			decl.Decs.Start.Append(c)
+		}
+		f.Decls = append(f.Decls, decl)
+	}
+	block(token.CONST, constSpecs)
+	block(token.TYPE, typeSpecs)
+	block(token.VAR, []dst.Spec{
+		&dst.ValueSpec{Names: []*dst.Ident{dst.NewIdent(onceVar)}, Type: &dst.Ident{Name: "Once", Path: "sync"}},
+		&dst.ValueSpec{Names: []*dst.Ident{dst.NewIdent(stateVar)}, Type: dst.Clone(state).(dst.Expr)},
+	})
+
+	// func Default() *lib.PackageState {
+	// 	defaultOnce.Do(func() { defaultState = lib.NewInstance() })
+	// 	return defaultState
+	// }
+	defaultDecl := &dst.FuncDecl{
+		Name: dst.NewIdent(defaultFunc),
+		Type: &dst.FuncType{
+			Params:  &dst.FieldList{},
+			Results: &dst.FieldList{List: []*dst.Field{{Type: dst.Clone(state).(dst.Expr)}}},
+		},
+		Body: &dst.BlockStmt{List: []dst.Stmt{
+			&dst.ExprStmt{X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{X: dst.NewIdent(onceVar), Sel: dst.NewIdent("Do")},
+				Args: []dst.Expr{&dst.FuncLit{
+					Type: &dst.FuncType{Params: &dst.FieldList{}},
+					Body: &dst.BlockStmt{List: []dst.Stmt{&dst.AssignStmt{
+						Lhs: []dst.Expr{dst.NewIdent(stateVar)},
+						Tok: token.ASSIGN,
+						Rhs: []dst.Expr{&dst.CallExpr{Fun: &dst.Ident{Name: lp.instanceFunc, Path: lp.pathNoVendor}}},
+					}}},
+				}},
+			}},
+			&dst.ReturnStmt{Results: []dst.Expr{dst.NewIdent(stateVar)}},
+		}},
+	}
+	defaultDecl.Decs.Before = dst.EmptyLine
+	defaultDecl.Decs.Start.Append(fmt.Sprintf("// %s returns the instance used by this package, which is created the first time it's", defaultFunc))
+	defaultDecl.Decs.Start.Append("// needed.")
+	f.Decls = append(f.Decls, defaultDecl)
+
+	for _, decl := range funcs {
+		decl.(*dst.FuncDecl).Decs.Before = dst.EmptyLine
+		f.Decls = append(f.Decls, decl)
+	}
+
+	if same {
+		lp.pkg.Syntax = append(lp.pkg.Syntax, f)
+		lp.pkg.Decorator.Filenames[f] = fpath
+		return nil
+	}
+	l.shims = append(l.shims, shim{path: l.options.Shim, fpath: fpath, file: f})
+	return nil
+}
+
+// generateShimFunc generates a function with the original signature of the exported function ob,
+// which calls the converted function with the default instance. If it can't be generated, the
+// reason is returned.
+func (l *libifier) generateShimFunc(lp *libifyPkg, ob *types.Func, typeExpr func(types.Type) (dst.Expr, bool), callDefault func() dst.Expr) (*dst.FuncDecl, string) {
+	sig := ob.Type().(*types.Signature)
+	if sig.TypeParams().Len() > 0 {
+		return nil, "generic functions aren't supported"
+	}
+
+	u := uniqueNamePicker{}
+	params := &dst.FieldList{}
+	args := []dst.Expr{callDefault()}
+	for i := 0; i < sig.Params().Len(); i++ {
+		v := sig.Params().At(i)
+		typ, ok := typeExpr(v.Type())
+		if !ok {
+			return nil, fmt.Sprintf("the type of parameter %d can't be used outside %s", i, lp.pathNoVendor)
+		}
+		name := v.Name()
+		if name == "" || name == "_" {
+			name = fmt.Sprintf("p%d", i)
+		}
+		name = u.pick(name)
+		if sig.Variadic() && i == sig.Params().Len()-1 {
+			typ = &dst.Ellipsis{Elt: typ.(*dst.ArrayType).Elt}
+		}
+		params.List = append(params.List, &dst.Field{Names: []*dst.Ident{dst.NewIdent(name)}, Type: typ})
+		args = append(args, dst.NewIdent(name))
+	}
+
+	var results *dst.FieldList
+	if sig.Results().Len() > 0 {
+		results = &dst.FieldList{}
+		for i := 0; i < sig.Results().Len(); i++ {
+			typ, ok := typeExpr(sig.Results().At(i).Type())
+			if !ok {
+				return nil, fmt.Sprintf("the type of result %d can't be used outside %s", i, lp.pathNoVendor)
+			}
+			results.List = append(results.List, &dst.Field{Type: typ})
+		}
+	}
+
+	call := &dst.CallExpr{
+		Fun:      &dst.Ident{Name: ob.Name(), Path: lp.pathNoVendor},
+		Args:     args,
+		Ellipsis: sig.Variadic(),
+	}
+	if l.isMethodFunc(lp, ob.Name()) {
+		// Default().F(...)
+		call.Fun = &dst.SelectorExpr{X: args[0], Sel: dst.NewIdent(ob.Name())}
+		call.Args = args[1:]
+	}
+	var stmt dst.Stmt = &dst.ExprStmt{X: call}
+	if results != nil {
+		stmt = &dst.ReturnStmt{Results: []dst.Expr{call}}
+	}
+	stmt.Decorations().Before = dst.NewLine
+	stmt.Decorations().After = dst.NewLine
+	return &dst.FuncDecl{
+		Name: dst.NewIdent(ob.Name()),
+		Type: &dst.FuncType{Params: params, Results: results},
+		Body: &dst.BlockStmt{List: []dst.Stmt{stmt}},
+	}, ""
+}
+
+// generateShimVarFunc generates a function for the exported var ob, which returns a pointer to the
+// field of the default instance:
+//
+//	func V() *T {
+//		return &DefaultInstance().V
+//	}
+//
+// If it can't be generated, the reason is returned.
+func (l *libifier) generateShimVarFunc(lp *libifyPkg, ob *types.Var, typeExpr func(types.Type) (dst.Expr, bool), callDefault func() dst.Expr) (*dst.FuncDecl, string) {
+	typ, ok := typeExpr(ob.Type())
+	if !ok {
+		return nil, fmt.Sprintf("the type of the var can't be used outside %s", lp.pathNoVendor)
+	}
+	stmt := &dst.ReturnStmt{Results: []dst.Expr{&dst.UnaryExpr{
+		Op: token.AND,
+		X:  &dst.SelectorExpr{X: callDefault(), Sel: dst.NewIdent(ob.Name())},
+	}}}
+	stmt.Decs.Before = dst.NewLine
+	stmt.Decs.After = dst.NewLine
+	decl := &dst.FuncDecl{
+		Name: dst.NewIdent(ob.Name()),
+		Type: &dst.FuncType{
+			Params:  &dst.FieldList{},
+			Results: &dst.FieldList{List: []*dst.Field{{Type: &dst.StarExpr{X: typ}}}},
+		},
+		Body: &dst.BlockStmt{List: []dst.Stmt{stmt}},
+	}
+	decl.Decs.Start.Append(fmt.Sprintf("// %s returns a pointer to the %s var of the default instance.", ob.Name(), ob.Name()))
+	return decl, ""
+}
+
+// saveShims writes the generated compatibility packages
+func (l *libifier) saveShims() error {
+	for _, s := range l.shims {
+		if err := os.MkdirAll(filepath.Dir(s.fpath), 0777); err != nil {
+			return errors.WithStack(err)
+		}
+		buf := &bytes.Buffer{}
+		if err := decorator.NewRestorerWithImports(s.path, guess.New()).Fprint(buf, s.file); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := ioutil.WriteFile(s.fpath, buf.Bytes(), 0666); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
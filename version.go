@@ -0,0 +1,27 @@
+package libify
+
+import "runtime/debug"
+
+// ModulePath is the module path of libify
+const ModulePath = "github.com/dave/libify"
+
+// Version returns the version of libify that the running binary was built with, from the build
+// info. If libify is the main module (e.g. the libify command), this is usually "(devel)".
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == ModulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == ModulePath {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}